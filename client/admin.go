@@ -0,0 +1,247 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+const (
+	ADMIN_COMMAND = "admin"
+	// How long squirrel waits for the admin API to respond
+	ADMIN_TIMEOUT = 10 * time.Second
+)
+
+func adminUsage() {
+	fprintf("Usage of %s %s:\n", os.Args[0], ADMIN_COMMAND)
+	fprintf(" %s %s [options] list\n", os.Args[0], ADMIN_COMMAND)
+	fprintf(" %s %s [options] inspect <session>\n", os.Args[0], ADMIN_COMMAND)
+	fprintf(" %s %s [options] kill <session>\n", os.Args[0], ADMIN_COMMAND)
+	fprintf(" %s %s [options] evict <session> <subscriber>\n", os.Args[0], ADMIN_COMMAND)
+}
+
+// RunAdmin runs a command of the admin API and returns the code squirrel has to exit with
+func RunAdmin(args []string) int {
+	arity := map[string]int{
+		"list":    0,
+		"inspect": 1,
+		"kill":    1,
+		"evict":   2,
+	}
+
+	expected, ok := arity[args[0]]
+
+	if !ok || len(args)-1 != expected {
+		adminUsage()
+		return 2
+	}
+
+	if options.AdminToken == "" {
+		fprintf("✖ Admin token is missing, pass --admin-token or set SQUIRREL_ADMIN_TOKEN\n")
+		return 2
+	}
+
+	var err error
+
+	switch args[0] {
+	case "list":
+		err = adminList()
+	case "inspect":
+		err = adminInspect(args[1])
+	case "kill":
+		err = adminRequest(http.MethodDelete, "/sessions/"+url.PathEscape(args[1]), nil)
+
+		if err == nil {
+			fmt.Printf("✔ Session [%s] was terminated\n", args[1])
+		}
+	case "evict":
+		err = adminRequest(http.MethodDelete, "/sessions/"+url.PathEscape(args[1])+"/subscribers/"+url.PathEscape(args[2]), nil)
+
+		if err == nil {
+			fmt.Printf("✔ Subscriber [%s] was evicted from session [%s]\n", args[2], args[1])
+		}
+	}
+
+	if err != nil {
+		fprintf("✖ %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func adminList() error {
+	var sessions []common.SessionInfo
+
+	if err := adminRequest(http.MethodGet, "/sessions", &sessions); err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "SESSION\tBROADCASTER\tSUBSCRIBERS\tLINES\tBYTES\tAGE")
+
+	for _, session := range sessions {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%s\t%s\n",
+			session.Id,
+			broadcasterAddress(session),
+			session.SubscriberCount,
+			session.LastSeq,
+			formatBytes(session.Bytes),
+			age(session.CreatedAt))
+	}
+
+	return writer.Flush()
+}
+
+func adminInspect(id string) error {
+	var session common.SessionInfo
+
+	if err := adminRequest(http.MethodGet, "/sessions/"+url.PathEscape(id), &session); err != nil {
+		return err
+	}
+
+	fmt.Printf("Session:     %s\n", session.Id)
+	fmt.Printf("Created:     %s (%s ago)\n", session.CreatedAt.Local().Format(time.RFC3339), age(session.CreatedAt))
+	fmt.Printf("Lines:       %d\n", session.LastSeq)
+	fmt.Printf("Bytes:       %s\n", formatBytes(session.Bytes))
+	fmt.Printf("Broadcaster: %s\n", broadcasterAddress(session))
+
+	if session.Broadcaster != nil {
+		fmt.Printf("Connected:   %s ago, received %s, sent %s\n",
+			age(session.Broadcaster.ConnectedAt),
+			formatBytes(session.Broadcaster.BytesReceived),
+			formatBytes(session.Broadcaster.BytesSent))
+
+		if session.Broadcaster.Certificate != "" {
+			fmt.Printf("Certificate: %s\n", session.Broadcaster.Certificate)
+		}
+	}
+
+	if session.Exit != nil {
+		fmt.Printf("Exit:        `%s` exited with code [%d]\n", session.Exit.Command, session.Exit.ExitCode)
+	}
+
+	fmt.Printf("Subscribers: %d\n", len(session.Subscribers))
+
+	if len(session.Subscribers) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "SUBSCRIBER\tADDRESS\tCONNECTED\tSENT\tDROPPED\tACKED\tLAG")
+
+	for _, subscriber := range session.Subscribers {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			subscriber.Id,
+			subscriber.Address,
+			age(subscriber.ConnectedAt),
+			formatBytes(subscriber.BytesSent),
+			subscriber.Dropped,
+			acked(subscriber),
+			lag(subscriber))
+	}
+
+	return writer.Flush()
+}
+
+// adminRequest calls the admin API and decodes its response into out unless it is nil
+func adminRequest(method string, path string, out interface{}) error {
+	request, err := http.NewRequest(method, options.Domain.Public+"/admin"+path, nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+options.AdminToken)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = options.TLS
+
+	client := http.Client{
+		Timeout:   ADMIN_TIMEOUT,
+		Transport: transport,
+	}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return errors.New("admin token was rejected by the server")
+	}
+
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("server responded with [%d]: %s", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+func broadcasterAddress(session common.SessionInfo) string {
+	if session.Broadcaster == nil {
+		return "(reconnecting)"
+	}
+
+	return session.Broadcaster.Address
+}
+
+// acked is the last line the subscriber acknowledged, subscribers that don't send acks have none
+func acked(peer common.PeerInfo) string {
+	if peer.Acked == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("#%d", peer.Acked)
+}
+
+// lag is how many lines the subscriber is behind the session, as far as its acks tell
+func lag(peer common.PeerInfo) string {
+	if peer.Acked == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%d", peer.Lag)
+}
+
+func age(since time.Time) string {
+	return time.Since(since).Round(time.Second).String()
+}
+
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+const (
+	DEFAULT_BATCH_SIZE     = "200"
+	DEFAULT_BATCH_INTERVAL = "10ms"
+	// Room kept in a batch for the event and ID around its lines
+	BATCH_ENVELOPE_SIZE = 256
+	// Escaping makes a character take at most 6 bytes in JSON (\u001b)
+	MAX_JSON_ESCAPE = 6
+	// Longest line kept while reading a stream when the server didn't tell how big a message can get
+	MAX_LINE_SIZE = 1024 * 1024
+)
+
+// batchPayload is a common.LogLinesMessage with lines that were already marshaled
+type batchPayload struct {
+	Lines []json.RawMessage `json:"lines"`
+}
+
+// Batch collects lines that are sent together in a single log_lines message
+type Batch struct {
+	lines []json.RawMessage
+	size  int
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Add appends the line unless it would make the batch bigger than limit bytes
+func (b *Batch) Add(line common.LogMessage, limit int) (bool, error) {
+	data, err := json.Marshal(line)
+
+	if err != nil {
+		return false, err
+	}
+
+	if b.size+len(data)+1 > limit {
+		return false, nil
+	}
+
+	b.lines = append(b.lines, data)
+	b.size += len(data) + 1
+
+	return true, nil
+}
+
+func (b *Batch) Len() int {
+	return len(b.lines)
+}
+
+// Take returns the log_lines message of the batch and empties it
+func (b *Batch) Take() common.Message {
+	message := common.Message{
+		Id:    clientId,
+		Event: common.EVENT_LOG_LINES,
+		Payload: batchPayload{
+			Lines: b.lines,
+		},
+	}
+
+	b.Reset()
+
+	return message
+}
+
+func (b *Batch) Reset() {
+	b.lines = nil
+	b.size = 0
+}
+
+// batchLimit is how big a batch can get, lines aren't batched at all when it is 0
+// which is the case when batching is turned off or the server doesn't support it
+func batchLimit() int {
+	if options.BatchSize <= 1 || !HasServerCapability(common.CAPABILITY_BATCH) {
+		return 0
+	}
+
+	return messageLimit()
+}
+
+// messageLimit is how big a single line can get, 0 when the server didn't tell
+func messageLimit() int {
+	limit, _ := serverMaxMessageSize.Load().(int64)
+
+	if limit <= 0 {
+		return 0
+	}
+
+	return int(limit) - BATCH_ENVELOPE_SIZE
+}
+
+// lineLimit is how much of a line is kept while reading a stream, anything longer can't be sent anyway
+func lineLimit() int {
+	if limit := messageLimit(); limit > 0 {
+		return limit
+	}
+
+	return MAX_LINE_SIZE
+}
+
+// fitLine cuts a line that is bigger than limit bytes once marshaled, server would close the
+// connection because of it otherwise and the line would be resent after every reconnection
+func fitLine(line common.LogMessage, limit int) common.LogMessage {
+	if limit <= 0 || (line.Structured == nil && len(line.Line)*MAX_JSON_ESCAPE < limit) {
+		return line
+	}
+
+	for {
+		data, err := json.Marshal(line)
+
+		if err != nil || len(data) <= limit || line.Line == "" {
+			return line
+		}
+
+		// Fields are dropped first, the line is only cut when it doesn't fit on its own
+		if line.Structured != nil {
+			line.Structured = nil
+			continue
+		}
+
+		// Cutting the excess is exact for plain text, cutting the same share of the line is for
+		// escaped characters, the line is cut again when it still doesn't fit
+		cut := len(line.Line) - (len(data) - limit)
+
+		if share := len(line.Line) * limit / len(data); share > cut {
+			cut = share
+		}
+
+		for cut > 0 && !utf8.RuneStart(line.Line[cut]) {
+			cut--
+		}
+
+		line.Line = line.Line[:cut]
+		line.Truncated = true
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+const (
+	BENCH_BATCH_SIZE    = 200
+	BENCH_MESSAGE_LIMIT = 512 * 1024
+	BENCH_LINE          = `2022-03-14T10:12:43.512Z	INFO	server/hub.go:118	Adding subscriber to session	{"id": "4f1d", "peerId": "9c2e"}`
+)
+
+// dialDiscard connects to a websocket server that reads and drops every message
+func dialDiscard(b *testing.B) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer connection.Close()
+
+		for {
+			if _, _, err := connection.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+
+	b.Cleanup(server.Close)
+
+	connection, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		b.Fatalf("dialing: %v", err)
+	}
+
+	b.Cleanup(func() { connection.Close() })
+
+	return connection
+}
+
+func benchLine(seq int) common.LogMessage {
+	return common.LogMessage{
+		Line:   BENCH_LINE,
+		Seq:    uint64(seq),
+		Stream: "stdout",
+	}
+}
+
+// BenchmarkSendUnbatched sends every line in its own log_line message
+func BenchmarkSendUnbatched(b *testing.B) {
+	connection := dialDiscard(b)
+
+	b.SetBytes(int64(len(BENCH_LINE)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := connection.WriteJSON(common.Message{
+			Id:      clientId,
+			Event:   common.EVENT_LOG_LINE,
+			Payload: benchLine(i),
+		})
+
+		if err != nil {
+			b.Fatalf("sending line: %v", err)
+		}
+	}
+}
+
+// BenchmarkSendBatched sends lines in log_lines messages of BENCH_BATCH_SIZE lines
+func BenchmarkSendBatched(b *testing.B) {
+	connection := dialDiscard(b)
+	batch := NewBatch()
+
+	flush := func() {
+		if err := connection.WriteJSON(batch.Take()); err != nil {
+			b.Fatalf("sending batch: %v", err)
+		}
+	}
+
+	b.SetBytes(int64(len(BENCH_LINE)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := batch.Add(benchLine(i), BENCH_MESSAGE_LIMIT); err != nil {
+			b.Fatalf("batching line: %v", err)
+		}
+
+		if batch.Len() >= BENCH_BATCH_SIZE {
+			flush()
+		}
+	}
+
+	if batch.Len() > 0 {
+		flush()
+	}
+}
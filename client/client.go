@@ -1,18 +1,73 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/omarahm3/squirrel/internal/pkg/common"
 	"go.uber.org/zap"
 )
 
+// stdout buffers received lines, it is flushed once the frame they came in is handled
+var stdout = bufio.NewWriter(os.Stdout)
+
+const (
+	RECONNECT_MIN_DELAY = 500 * time.Millisecond
+	RECONNECT_MAX_DELAY = 30 * time.Second
+	// Server pings every minute or so, missing a couple of pings means the connection is dead
+	READ_WAIT = 2 * time.Minute
+	// Printed after lines the broadcaster had to cut
+	TRUNCATED_MARKER = " … [truncated]"
+)
+
+// Dial connects to the server without identifying
+func Dial() (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = options.Compression
+	dialer.TLSClientConfig = options.TLS
+
+	connection, response, err := dialer.Dial(fmt.Sprintf("%s/ws", options.Domain.Websocket), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	zap.S().Debugw("Connected to server", "extensions", response.Header.Get("Sec-Websocket-Extensions"))
+
+	// Level only applies if the server agreed on compression
+	_ = connection.SetCompressionLevel(options.CompressionLevel)
+
+	connection.SetReadDeadline(time.Now().Add(READ_WAIT))
+	connection.SetPingHandler(func(data string) error {
+		connection.SetReadDeadline(time.Now().Add(READ_WAIT))
+
+		err := connection.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+
+		// Same as the default ping handler, these errors are not worth closing the connection for
+		var netError net.Error
+
+		if err == websocket.ErrCloseSent || (errors.As(err, &netError) && netError.Timeout()) {
+			return nil
+		}
+
+		return err
+	})
+
+	return connection, nil
+}
+
 func InitClient() *websocket.Conn {
 	zap.S().Debug("Initiating websocket client")
 
-	connection, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s/ws", options.Domain.Websocket), nil)
+	connection, err := Dial()
 
 	if err != nil {
 		zap.S().Error("Error connecting to websocket server: ", err)
@@ -24,14 +79,120 @@ func InitClient() *websocket.Conn {
 	return connection
 }
 
-func handleIncomingJSONMessages(message []byte) error {
-	jsonMessage, err := common.NewMessageFromString(message)
+// KeepConnected waits for the connection to drop and reconnects unless the server closed it on purpose
+func KeepConnected(connection *websocket.Conn, done chan error) {
+	for {
+		err := <-done
 
-	if err != nil {
-		return err
+		// Abnormal closure is reported when connection dropped without a close frame
+		var closeError *websocket.CloseError
+
+		// Server asks subscribers that can't keep up to try again later, they resume from their last line
+		// and it asks everyone to reconnect when it restarts
+		if errors.As(err, &closeError) &&
+			closeError.Code != websocket.CloseAbnormalClosure &&
+			closeError.Code != websocket.CloseTryAgainLater &&
+			closeError.Code != websocket.CloseServiceRestart {
+			HandleWebsocketClose(ControllerMessage{
+				Error:      err,
+				Connection: connection,
+				Message:    "Server closed the connection",
+			})
+			return
+		}
+
+		zap.L().Warn("Connection to server was lost", zap.Error(err))
+
+		connection, done = Reconnect()
+	}
+}
+
+// Reconnect dials the server with backoff until the same identity is accepted again
+func Reconnect() (*websocket.Conn, chan error) {
+	delay := RECONNECT_MIN_DELAY
+
+	// Peers are spread over the delay the server asked for so they don't all reconnect at once
+	if d := time.Duration(atomic.SwapInt64(&shutdownDelay, 0)); d > 0 {
+		delay = d + time.Duration(rand.Int63n(int64(d)))
 	}
 
-	if jsonMessage.Event == EVENT_SUBSCRIBER_ACK {
+	for {
+		fmt.Fprintf(os.Stderr, "⚠ Connection to server was lost, reconnecting in %s...\n", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+
+		delay *= 2
+
+		if delay > RECONNECT_MAX_DELAY {
+			delay = RECONNECT_MAX_DELAY
+		}
+
+		connection, err := Dial()
+
+		if err != nil {
+			zap.S().Warnw("Error reconnecting to websocket server", "error", err)
+			continue
+		}
+
+		done := make(chan error, 1)
+
+		go HandleIncomingMessages(connection, done)
+
+		SendHello(connection)
+		SendIdentity(connection, clientId)
+
+		if options.Listen {
+			fmt.Fprintln(os.Stderr, "✔ Reconnected to server")
+			connections <- resumption{connection: connection}
+			return connection, done
+		}
+
+		select {
+		case session := <-sessions:
+			// Server lost the session so it was created again with new credentials
+			if session.Token != "" {
+				PrintSession(session)
+			}
+
+			fmt.Fprintf(os.Stderr, "✔ Reconnected to server, resuming after line #%d\n", session.LastSeq)
+			connections <- resumption{connection: connection, lastSeq: session.LastSeq}
+			return connection, done
+		case err := <-done:
+			zap.S().Warnw("Connection was lost while waiting for session", "error", err)
+		case <-time.After(SESSION_TIMEOUT):
+			zap.S().Warn("Server didn't send session details in time")
+			connection.Close()
+		}
+	}
+}
+
+// HasServerCapability checks if the server agreed on capability in its hello
+func HasServerCapability(capability string) bool {
+	capabilities, _ := serverCapabilities.Load().([]string)
+
+	return common.HasCapability(capabilities, capability)
+}
+
+func handleIncomingJSONMessages(jsonMessage common.Message) error {
+	if jsonMessage.Event == common.EVENT_HELLO {
+		m, err := jsonMessage.ToHelloMessage()
+
+		if err != nil {
+			return err
+		}
+
+		zap.S().Debugw("Server said hello", "version", m.Version, "capabilities", m.Capabilities)
+
+		if m.Version < common.MIN_PROTOCOL_VERSION || m.Version > common.PROTOCOL_VERSION {
+			fmt.Fprintf(os.Stderr, "✖ Server speaks protocol version [%d] which this squirrel doesn't support, please upgrade squirrel\n", m.Version)
+			controller <- 1
+			return nil
+		}
+
+		serverCapabilities.Store(m.Capabilities)
+		serverMaxMessageSize.Store(m.MaxMessageSize)
+	}
+
+	if jsonMessage.Event == common.EVENT_SUBSCRIBER_ACK {
 		m, err := jsonMessage.ToSubscriberConnectedMessage()
 
 		if err != nil {
@@ -39,46 +200,225 @@ func handleIncomingJSONMessages(message []byte) error {
 		}
 
 		if m.Connected {
-			events <- EVENT_SUBSCRIBER_ACK
+			events <- common.EVENT_SUBSCRIBER_ACK
 		}
 	}
 
+	if jsonMessage.Event == common.EVENT_SESSION {
+		m, err := jsonMessage.ToSessionMessage()
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case sessions <- m:
+		default:
+			zap.S().Warn("Session details were already received, ignoring")
+		}
+	}
+
+	if jsonMessage.Event == common.EVENT_LOG_ACK {
+		m, err := jsonMessage.ToAckMessage()
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case acks <- m.Seq:
+		default:
+			// Sender is busy, next ack covers this one anyway
+		}
+	}
+
+	if jsonMessage.Event == common.EVENT_LOG_LINE && options.Listen {
+		m, err := jsonMessage.ToLogMessage()
+
+		if err != nil {
+			return err
+		}
+
+		if receive(m.Seq) {
+			printLine(m)
+		}
+	}
+
+	if jsonMessage.Event == common.EVENT_TERM_FRAME && options.Listen {
+		m, err := jsonMessage.ToTermFrameMessage()
+
+		if err != nil {
+			return err
+		}
+
+		// Frames are written as is so the local terminal renders them like the broadcaster terminal
+		if receive(m.Seq) {
+			_, _ = stdout.Write(m.Data)
+		}
+	}
+
+	if jsonMessage.Event == common.EVENT_LINES_SKIPPED && options.Listen {
+		m, err := jsonMessage.ToLinesSkippedMessage()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "⚠ Server skipped %d lines, squirrel couldn't keep up\n", m.Count)
+
+		// Skipped lines were already reported, they shouldn't show up as missing as well
+		if m.Seq > atomic.LoadUint64(&lastSeq) {
+			atomic.StoreUint64(&lastSeq, m.Seq)
+		}
+	}
+
+	if jsonMessage.Event == common.EVENT_PROCESS_EXIT {
+		m, err := jsonMessage.ToProcessExitMessage()
+
+		if err != nil {
+			return err
+		}
+
+		if !options.Listen {
+			select {
+			case exitConfirmations <- struct{}{}:
+			default:
+			}
+
+			return nil
+		}
+
+		printProcessExit(m)
+	}
+
+	if jsonMessage.Event == common.EVENT_SERVER_SHUTDOWN {
+		m, err := jsonMessage.ToServerShutdownMessage()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(os.Stderr, "⚠ Server is shutting down")
+
+		atomic.StoreInt64(&shutdownDelay, int64(time.Duration(m.ReconnectIn)*time.Millisecond))
+	}
+
+	if jsonMessage.Event == common.EVENT_ERROR {
+		m, err := jsonMessage.ToErrorMessage()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "✖ Server rejected squirrel (%s): %s\n", m.Code, m.Message)
+
+		if m.Code == common.ERROR_INCOMPATIBLE_VERSION {
+			fmt.Fprintln(os.Stderr, "✖ This squirrel is not compatible with the server, please upgrade squirrel")
+		}
+
+		controller <- 1
+	}
+
 	return nil
 }
 
-func HandleIncomingMessages(connection *websocket.Conn) {
+// receive tracks the last received sequence, it returns false for lines that were already
+// received which happens when they're replayed after reconnecting
+func receive(seq uint64) bool {
+	previous := atomic.LoadUint64(&lastSeq)
+
+	if seq != 0 && seq <= previous {
+		return false
+	}
+
+	// Lines left out by the filter aren't missing
+	if previous != 0 && seq > previous+1 && options.Filter.IsEmpty() {
+		fmt.Fprintf(os.Stderr, "⚠ Missed %d lines (#%d to #%d)\n", seq-previous-1, previous+1, seq-1)
+	}
+
+	atomic.StoreUint64(&lastSeq, seq)
+
+	return true
+}
+
+// printLine writes a received line unless its stream was filtered out with --streams
+// lines are prefixed with their stream unless a single stream is being followed
+// terminal frames aren't going through here, they're always written as is
+func printLine(message common.LogMessage) {
+	if len(options.Streams) > 0 && !common.Contains(options.Streams, message.StreamName()) {
+		return
+	}
+
+	if options.StripColors {
+		message.Line = common.StripANSI(message.Line)
+	}
+
+	if message.Truncated {
+		message.Line += TRUNCATED_MARKER
+	}
+
+	if message.Stream == "" || len(options.Streams) == 1 {
+		fmt.Fprintln(stdout, message.Line)
+		return
+	}
+
+	fmt.Fprintf(stdout, "[%s] %s\n", message.Stream, message.Line)
+}
+
+// HandleIncomingMessages reads from the connection until it fails, the error is then sent to done
+func HandleIncomingMessages(connection *websocket.Conn, done chan error) {
 	defer func() {
 		connection.Close()
 		zap.S().Info("Client connection closed")
 	}()
 
 	for {
-		_, message, err := connection.ReadMessage()
+		_, data, err := connection.ReadMessage()
+
+		if err != nil {
+			done <- err
+			return
+		}
+
+		// Server may write several messages in the same frame separated by new lines
+		for _, message := range bytes.Split(data, []byte{'\n'}) {
+			if !common.IsJSON(string(message)) {
+				if options.Listen && options.PeerId != "" {
+					fmt.Fprintln(stdout, string(message))
+				}
 
-		if common.IsJSON(string(message)) {
-			err := handleIncomingJSONMessages(message)
+				continue
+			}
+
+			jsonMessage, err := common.NewMessageFromString(message)
 
 			if err != nil {
-				break
+				continue
 			}
-		}
 
-		if options.Listen && options.PeerId != "" {
-			fmt.Println(string(message))
-		}
+			// Notices are written to stderr, lines received before them must be written first
+			if jsonMessage.Event != common.EVENT_LOG_LINE && jsonMessage.Event != common.EVENT_TERM_FRAME {
+				_ = stdout.Flush()
+			}
 
-		if err != nil {
-			HandleWebsocketClose(ControllerMessage{
-				Error:      err,
-				Connection: connection,
-				Message:    "Error while reading incoming message",
-			})
-			break
+			err = handleIncomingJSONMessages(jsonMessage)
+
+			if err != nil {
+				zap.L().Error("Error handling incoming message", zap.Error(err))
+			}
 		}
+
+		_ = stdout.Flush()
 	}
 }
 
 func HandleWebsocketClose(message ControllerMessage) {
+	if websocket.IsCloseError(message.Error, websocket.CloseMessageTooBig) {
+		fmt.Fprintln(os.Stderr, "✖ Server closed the connection because a message was bigger than it accepts")
+		controller <- 1
+		return
+	}
+
 	if websocket.IsUnexpectedCloseError(message.Error, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseMessage) {
 		controller <- 1
 	} else {
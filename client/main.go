@@ -2,9 +2,18 @@ package client
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/atotto/clipboard"
 	"github.com/gorilla/websocket"
@@ -19,18 +28,44 @@ type ControllerMessage struct {
 	Connection *websocket.Conn
 }
 
+// resumption hands a new connection to the sender along with the last line server has
+type resumption struct {
+	connection *websocket.Conn
+	lastSeq    uint64
+}
+
 var (
-	interrupt  chan os.Signal
-	options    *ClientOptions
-	clientId   string
-	controller = make(chan int)
-	events     = make(chan string)
-	input      = make(chan string)
+	interrupt chan os.Signal
+	options   *ClientOptions
+	clientId  string
+	// Secret issued by the server to this broadcaster, it is needed to claim the same ID again
+	sessionSecret string
+	sessionLink   string
+	controller    = make(chan int)
+	events        = make(chan string)
+	input         = make(chan common.Message, INPUT_BUFFER_SIZE)
+	sessions      = make(chan common.SessionMessage, 1)
+	connections   = make(chan resumption)
+	acks          = make(chan uint64, 1)
+	scanOnce      sync.Once
+	// Last line sequence received while listening, it must be accessed atomically
+	lastSeq uint64
+	// Capabilities negotiated with the server in hello
+	serverCapabilities atomic.Value
+	// Largest message the server reads, as sent in its hello
+	serverMaxMessageSize atomic.Value
+	// Delay the server asked for before reconnecting when it shut down, it must be accessed atomically
+	shutdownDelay int64
 )
 
 const (
-	EVENT_IDENTITY       = "identity"
-	EVENT_SUBSCRIBER_ACK = "subscriber_ack"
+	SESSION_TIMEOUT = 10 * time.Second
+	// Number of lines read from stdin and tailed files that can be held locally while they're being sent
+	INPUT_BUFFER_SIZE = 4096
+	// Number of sent lines kept until server acknowledges them, to be resent after reconnecting
+	MAX_PENDING_LINES = 10000
+	// How often a listener acknowledges received lines to the server
+	ACK_PERIOD = time.Second
 )
 
 func isStdin() bool {
@@ -47,8 +82,20 @@ func isStdin() bool {
 func Main() {
 	options = InitOptions()
 
-	if !options.Listen && !isStdin() {
-		fmt.Println("Nothing is being read, you should pipe something to stdin of this command")
+	// Reconnect delays are randomized so peers of a restarting server don't reconnect all at once
+	rand.Seed(time.Now().UnixNano())
+
+	if len(options.Admin) > 0 {
+		os.Exit(RunAdmin(options.Admin))
+	}
+
+	if options.Listen && len(options.Command) > 0 {
+		fmt.Println("Commands can't be run in listen mode")
+		return
+	}
+
+	if !options.Listen && !isStdin() && len(options.Files) == 0 && len(options.Command) == 0 {
+		fmt.Println("Nothing is being read, you should pipe something to stdin of this command or pass --file")
 		return
 	}
 
@@ -65,39 +112,62 @@ func Main() {
 		_ = zap.S().Sync()
 	}()
 
-	clientId = common.GenerateUUID()
+	clientId = options.Id
 
-	zap.S().Debug("Client ID was generated: ", clientId)
+	if clientId == "" {
+		clientId = common.GenerateUUID()
+		zap.S().Debug("Client ID was generated: ", clientId)
+	}
 
 	signal.Notify(interrupt, os.Interrupt)
 
 	connection := InitClient()
+	done := make(chan error, 1)
 
-	defer connection.Close()
+	go HandleIncomingMessages(connection, done)
 
+	SendHello(connection)
 	SendIdentity(connection, clientId)
 
+	var session common.SessionMessage
+
 	if !options.Listen {
-		link := fmt.Sprintf("%s/client/%s", options.Domain.Public, clientId)
+		var err error
+
+		session, err = WaitForSession(done)
 
-		fmt.Printf("➜ ID: [ %s ]\n", clientId)
-		fmt.Printf("➜ Link: [ %s ]\n", link)
+		if err != nil {
+			fmt.Println("Couldn't start sharing session:", err)
+			return
+		}
+
+		PrintSession(session)
 
 		if options.UrlClipboard {
-			err := clipboard.WriteAll(link)
+			err := clipboard.WriteAll(sessionLink)
 
 			if err != nil {
 				zap.S().Warnw("Error occurred while writing link to clipboard", "error", zap.Error(err))
 			} else {
 				fmt.Println("➜ Url is copied to your clipboard")
-				fmt.Println("📢 Squirrel is waiting for listeners to begin piping stdout...")
+
+				if !options.NoWait {
+					fmt.Println("📢 Squirrel is waiting for listeners to begin piping stdout...")
+				}
 			}
 		}
 	}
 
 	go HandleEvents()
-	go HandleSendEvents(connection)
-	go HandleIncomingMessages(connection)
+	go HandleSendEvents()
+	go KeepConnected(connection, done)
+
+	connections <- resumption{connection: connection, lastSeq: session.LastSeq}
+
+	if !options.Listen && options.NoWait {
+		fmt.Println("📢 Squirrel is piping stdout, listeners will catch up once they join")
+		StartScanning()
+	}
 
 	// Main CLI loop
 	for {
@@ -105,54 +175,311 @@ func Main() {
 		case <-interrupt:
 			zap.S().Info("Received SIGINT interrupt signal. Closing all pending connections")
 			return
-		case <-controller:
+		case code := <-controller:
+			if code != 0 {
+				_ = zap.L().Sync()
+				os.Exit(code)
+			}
+
 			return
+		case code := <-processExits:
+			_ = zap.L().Sync()
+			_ = zap.S().Sync()
+			os.Exit(code)
 		}
 	}
 }
 
-func HandleSendEvents(connection *websocket.Conn) {
-	defer func() {
-		connection.Close()
-		zap.S().Info("Client connection closed")
-	}()
+// PrintSession prints the shareable details of the broadcaster session
+func PrintSession(session common.SessionMessage) {
+	// Token is only sent the first time, a resumed session keeps the link it was first shared with
+	token := session.Token
+	sessionLink = fmt.Sprintf("%s/client/%s", options.Domain.Public, clientId)
 
-	// Here we receive packets
-	for {
-		line := <-input
-		err := connection.WriteJSON(common.Message{
-			Id:    clientId,
-			Event: "log_line",
-			Payload: common.LogMessage{
-				Line: line,
-			},
-		})
+	if token != "" {
+		sessionLink = fmt.Sprintf("%s?token=%s", sessionLink, url.QueryEscape(token))
+	}
+
+	fmt.Printf("➜ ID: [ %s ]\n", clientId)
+
+	if token != "" {
+		fmt.Printf("➜ Token: [ %s ]\n", token)
+	} else {
+		fmt.Println("➜ Token: [ unchanged ] (listeners keep using the token of the first link)")
+	}
+
+	fmt.Printf("➜ Link: [ %s ]\n", sessionLink)
+
+	if session.Secret != "" {
+		sessionSecret = session.Secret
+		fmt.Printf("➜ Secret: [ %s ] (keep it to resume this session using --id and --secret)\n", sessionSecret)
+	}
+}
+
+// WaitForSession blocks until server sends the session details of this broadcaster
+func WaitForSession(done chan error) (common.SessionMessage, error) {
+	select {
+	case session := <-sessions:
+		return session, nil
+	case err := <-done:
+		return common.SessionMessage{}, err
+	case <-controller:
+		return common.SessionMessage{}, errors.New("connection to server was closed")
+	case <-time.After(SESSION_TIMEOUT):
+		return common.SessionMessage{}, errors.New("server didn't send session details in time")
+	}
+}
+
+// HandleSendEvents numbers lines and sends them over the current connection
+// lines are kept until acknowledged so they survive reconnecting, when listening
+// it acknowledges received lines instead
+func HandleSendEvents() {
+	var connection *websocket.Conn
+	var seq, acked uint64
+	// Process exit is kept till the server confirms it, just like lines
+	var exit *common.ProcessExitMessage
+	// Fires once the oldest line of the batch waited long enough, nil while the batch is empty
+	var flush <-chan time.Time
+
+	pending := NewPending(MAX_PENDING_LINES)
+	batch := NewBatch()
+	ticker := time.NewTicker(ACK_PERIOD)
+
+	defer ticker.Stop()
+
+	send := func(message common.Message) error {
+		err := connection.WriteJSON(message)
 
 		if err != nil {
 			zap.S().Error("Error during sending message to websocket:", zap.Error(err))
-			return
+			// Reader will notice the connection is closed and reconnect
+			connection.Close()
+			connection = nil
+		}
+
+		return err
+	}
+
+	flushBatch := func() error {
+		flush = nil
+
+		if batch.Len() == 0 {
+			return nil
+		}
+
+		message := batch.Take()
+
+		// Lines of the batch are still pending, they're resent after reconnecting
+		if connection == nil {
+			return nil
+		}
+
+		return send(message)
+	}
+
+	// write adds lines to the batch when the server supports it, anything else is sent right
+	// away after the batch so the order is kept
+	write := func(message common.Message) error {
+		line, isLine := message.Payload.(common.LogMessage)
+		limit := batchLimit()
+
+		if isLine {
+			line = fitLine(line, messageLimit())
+			message.Payload = line
+		}
+
+		if isLine && limit > 0 {
+			added, err := batch.Add(line, limit)
+
+			if err != nil {
+				return err
+			}
+
+			if !added {
+				if err := flushBatch(); err != nil {
+					return err
+				}
+
+				added, err = batch.Add(line, limit)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			if added {
+				if batch.Len() >= options.BatchSize {
+					return flushBatch()
+				}
+
+				if flush == nil {
+					flush = time.After(options.BatchInterval)
+				}
+
+				return nil
+			}
+		}
+
+		// Line is too big to be batched, it is sent on its own
+		if err := flushBatch(); err != nil {
+			return err
+		}
+
+		if connection == nil {
+			return nil
+		}
+
+		return send(message)
+	}
+
+	queue := func(message common.Message) {
+		seq++
+		message = withSeq(message, seq)
+
+		pending.Add(message)
+
+		if connection != nil {
+			_ = write(message)
+		}
+	}
+
+	for {
+		select {
+		case r := <-connections:
+			connection = r.connection
+			pending.Acknowledge(r.lastSeq)
+			// Lines of the batch are pending as well, they're sent again below
+			batch.Reset()
+			flush = nil
+
+			// Resumed session already has lines from another squirrel, continue after them
+			if seq < r.lastSeq {
+				seq = r.lastSeq
+			}
+
+			for _, message := range pending.Messages() {
+				if write(message) != nil {
+					break
+				}
+			}
+
+			_ = flushBatch()
+
+			if exit != nil && connection != nil {
+				sendExit(connection, *exit)
+			}
+
+		case ack := <-acks:
+			pending.Acknowledge(ack)
+
+		case <-ticker.C:
+			received := atomic.LoadUint64(&lastSeq)
+
+			if !options.Listen || connection == nil || received == acked || !HasServerCapability(common.CAPABILITY_ACKS) {
+				continue
+			}
+
+			err := connection.WriteJSON(common.Message{
+				Id:    clientId,
+				Event: common.EVENT_LOG_ACK,
+				Payload: common.AckMessage{
+					Seq: received,
+				},
+			})
+
+			if err != nil {
+				zap.S().Warnw("Error acknowledging received lines", "error", err)
+				continue
+			}
+
+			acked = received
+
+		case message := <-input:
+			queue(message)
+
+		case <-flush:
+			_ = flushBatch()
+
+		case e := <-exits:
+			exit = &e
+
+			// Command output is fully read before it exits, make sure it is all sent before the exit
+			for len(input) > 0 {
+				queue(<-input)
+			}
+
+			_ = flushBatch()
+
+			if connection != nil {
+				sendExit(connection, *exit)
+			}
 		}
 	}
 }
 
+func sendExit(connection *websocket.Conn, exit common.ProcessExitMessage) {
+	err := connection.WriteJSON(common.Message{
+		Id:      clientId,
+		Event:   common.EVENT_PROCESS_EXIT,
+		Payload: exit,
+	})
+
+	if err != nil {
+		zap.S().Warnw("Error sending process exit, it will be sent again after reconnecting", "error", err)
+	}
+}
+
+// SendHello tells the server which protocol version and capabilities this squirrel has
+func SendHello(connection *websocket.Conn) {
+	message := common.Message{
+		Id:      clientId,
+		Event:   common.EVENT_HELLO,
+		Payload: common.NewHelloMessage(),
+	}
+
+	zap.L().Info("Sending hello: ", zap.Object("message", message))
+
+	err := connection.WriteJSON(message)
+
+	if err != nil {
+		zap.S().Error("Error sending hello message", zap.Error(err))
+	}
+}
+
 func SendIdentity(connection *websocket.Conn, clientId string) {
-	var peerId string
+	var peerId, token string
 	var subscriber bool
+	var filter *common.FilterMessage
+	var slowPolicy string
 	broadcaster := true
+	ownerSecret := common.WinningDefault(sessionSecret, options.Secret)
 
 	if options.PeerId != "" && options.Listen {
 		peerId = options.PeerId
+		token = options.Token
 		subscriber = true
 		broadcaster = false
+		ownerSecret = ""
+
+		if !options.Filter.IsEmpty() {
+			filter = options.Filter
+		}
+
+		slowPolicy = options.SlowPolicy
 	}
 
 	message := common.Message{
 		Id:    clientId,
-		Event: EVENT_IDENTITY,
+		Event: common.EVENT_IDENTITY,
 		Payload: common.IdentityMessage{
 			PeerId:      peerId,
 			Broadcaster: broadcaster,
 			Subscriber:  subscriber,
+			Token:       token,
+			Secret:      ownerSecret,
+			Since:       atomic.LoadUint64(&lastSeq),
+			Filter:      filter,
+			SlowPolicy:  slowPolicy,
 		},
 	}
 
@@ -173,30 +500,141 @@ func HandleEvents() {
 		event := <-events
 
 		switch event {
-		case EVENT_SUBSCRIBER_ACK:
+		case common.EVENT_SUBSCRIBER_ACK:
+			StartScanning()
+		}
+	}
+}
+
+// StartScanning begins reading stdin and tailing files, it is safe to be called multiple times
+// since they must only be read once no matter how many subscribers joined
+func StartScanning() {
+	scanOnce.Do(func() {
+		if !options.NoWait {
 			screen.Clear()
 			screen.MoveTopLeft()
-			go ScanFile()
 		}
+
+		// Wrapped command reads stdin itself
+		if len(options.Command) > 0 {
+			go RunCommand(options.Command)
+		} else if isStdin() {
+			go ScanStream(os.Stdin, options.Stream, os.Stdout)
+		}
+
+		for _, file := range options.Files {
+			go TailFile(file)
+		}
+	})
+}
+
+// ScanStream sends every line of reader on the named stream until it is exhausted
+// lines are written to echo as well when --show-output is set
+func ScanStream(reader io.Reader, stream string, echo io.Writer) {
+	zap.S().Debugw("Scanning stream", "stream", stream)
+
+	lines := newLineGrouper(stream)
+	defer lines.Flush()
+
+	buffered := bufio.NewReader(reader)
+
+	if !options.Output {
+		echo = nil
+	}
+
+	for {
+		line, truncated, err := readLine(buffered, lineLimit(), echo)
+
+		if err == nil || line != "" {
+			lines.Add(line, truncated)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if err != io.EOF {
+			zap.S().Error("Error scanning stream", zap.String("stream", stream), zap.Error(err))
+			// Writer would block on a full pipe forever otherwise
+			_, _ = io.Copy(io.Discard, buffered)
+		}
+
+		return
 	}
 }
 
-func ScanFile() {
-	zap.S().Debug("Scanning log file")
+// readLine reads a line without its line ending, only its first limit bytes are kept and truncated
+// is set when it was longer, the rest is read anyway so the next line starts where it should.
+// Lines are written to echo as they are read when it isn't nil
+func readLine(reader *bufio.Reader, limit int, echo io.Writer) (line string, truncated bool, err error) {
+	var kept []byte
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		text := scanner.Text()
+		if echo != nil {
+			_, _ = echo.Write(chunk)
 
-		if options.Output {
-			fmt.Println(text)
+			if err != nil && err != bufio.ErrBufferFull && len(kept)+len(chunk) > 0 {
+				_, _ = fmt.Fprintln(echo)
+			}
 		}
 
-		input <- text
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		if !truncated {
+			if keep := limit - len(kept); len(chunk) > keep {
+				for keep > 0 && !utf8.RuneStart(chunk[keep]) {
+					keep--
+				}
+
+				chunk = chunk[:keep]
+				truncated = true
+			}
+
+			kept = append(kept, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == nil && !truncated {
+			kept = bytes.TrimSuffix(kept, []byte{'\r'})
+		}
+
+		return string(kept), truncated, err
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		zap.S().Error("Error scanning file", zap.Error(err))
-		return
+// echoLine writes the line as soon as it is read when --show-output is set, before it is grouped
+func echoLine(line string, echo io.Writer) {
+	if options.Output {
+		fmt.Fprintln(echo, line)
+	}
+}
+
+func sendLine(line string, stream string, truncated bool) {
+	message := common.LogMessage{
+		Line:      line,
+		Stream:    stream,
+		Truncated: truncated,
+	}
+
+	if options.ParseJSON {
+		message.Structured = common.ParseStructuredLog(line)
+
+		// Fields are sent along with the line, it is sent as it is when both don't fit in a message
+		if limit := messageLimit(); limit > 0 && len(line)+message.Structured.Size() > limit {
+			message.Structured = nil
+		}
+	}
+
+	input <- common.Message{
+		Id:      clientId,
+		Event:   common.EVENT_LOG_LINE,
+		Payload: message,
 	}
 }
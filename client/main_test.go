@@ -0,0 +1,43 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("é", 100*1024)
+	input := long + "\nnext\r\n\nlast"
+
+	var echo bytes.Buffer
+	reader := bufio.NewReader(strings.NewReader(input))
+
+	expected := []struct {
+		line      string
+		truncated bool
+		err       error
+	}{
+		{long[:1000], true, nil},
+		{"next", false, nil},
+		{"", false, nil},
+		{"last", false, io.EOF},
+		{"", false, io.EOF},
+	}
+
+	for i, e := range expected {
+		// Limit cuts a 2 bytes character in the middle, it must be kept whole or not at all
+		line, truncated, err := readLine(reader, 1001, &echo)
+
+		if line != e.line || truncated != e.truncated || err != e.err {
+			t.Fatalf("line %d: got %.20q (%d bytes) truncated %v error %v, expected %.20q (%d bytes) truncated %v error %v",
+				i, line, len(line), truncated, err, e.line, len(e.line), e.truncated, e.err)
+		}
+	}
+
+	if echo.String() != input+"\n" {
+		t.Fatalf("echo doesn't match the input, got %d bytes instead of %d", echo.Len(), len(input)+1)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MULTILINE_MAX_LINES = "500"
+	DEFAULT_MULTILINE_TIMEOUT   = "500ms"
+)
+
+// MultilineOptions decide which lines belong to the record before them, like the frames of a stack trace
+type MultilineOptions struct {
+	// Pattern matches lines that continue the previous record e.g. `^\s+at ` for Java stack traces
+	Pattern *regexp.Regexp
+	// Indent makes lines starting with a space or a tab continue the previous record
+	Indent   bool
+	MaxLines int
+	// Timeout is how long a record waits for more lines before it is sent
+	Timeout time.Duration
+}
+
+func (o MultilineOptions) Enabled() bool {
+	return o.Pattern != nil || o.Indent
+}
+
+func (o MultilineOptions) isContinuation(line string) bool {
+	if o.Indent && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+		return true
+	}
+
+	return o.Pattern != nil && o.Pattern.MatchString(line)
+}
+
+// lineGrouper joins the lines of a single source into records, every source needs its own
+// so lines of stdout never end up in a stack trace of stderr
+type lineGrouper struct {
+	mu      sync.Mutex
+	options MultilineOptions
+	stream  string
+	lines   []string
+	// truncated is set when a line of the record was cut while it was read
+	truncated bool
+	// generation tells a flush timer apart from the ones of records that were already sent
+	generation uint64
+	timer      *time.Timer
+}
+
+func newLineGrouper(stream string) *lineGrouper {
+	return &lineGrouper{
+		options: options.Multiline,
+		stream:  stream,
+	}
+}
+
+// Add sends the line right away when grouping is off, otherwise it is held till the record is complete
+// truncated is set when the line was cut while it was read
+func (g *lineGrouper) Add(line string, truncated bool) {
+	if !g.options.Enabled() {
+		sendLine(line, g.stream, truncated)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	full := g.options.MaxLines > 0 && len(g.lines) >= g.options.MaxLines
+
+	if len(g.lines) > 0 && !full && g.options.isContinuation(line) {
+		g.lines = append(g.lines, line)
+		g.truncated = g.truncated || truncated
+		g.schedule()
+		return
+	}
+
+	g.flush()
+	g.lines = []string{line}
+	g.truncated = truncated
+	g.schedule()
+}
+
+// Flush sends the record being grouped, it has to be called once the source is exhausted
+func (g *lineGrouper) Flush() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.flush()
+}
+
+func (g *lineGrouper) schedule() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+
+	g.generation++
+	generation := g.generation
+
+	g.timer = time.AfterFunc(g.options.Timeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		// Timer fired while a newer line was being added, the record isn't over yet
+		if generation == g.generation {
+			g.flush()
+		}
+	})
+}
+
+func (g *lineGrouper) flush() {
+	g.generation++
+
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+
+	if len(g.lines) == 0 {
+		return
+	}
+
+	sendLine(strings.Join(g.lines, "\n"), g.stream, g.truncated)
+	g.lines = nil
+	g.truncated = false
+}
@@ -1,12 +1,17 @@
 package client
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/omarahm3/squirrel/internal/pkg/common"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/term"
 )
 
 type ClientOptions struct {
@@ -14,27 +19,104 @@ type ClientOptions struct {
 	Domain       *common.Domain
 	LogLevel     zapcore.Level
 	PeerId       string
+	Token        string
+	Id           string
+	Secret       string
 	Listen       bool
 	Output       bool
 	UrlClipboard bool
+	NoWait       bool
+	Stream       string
+	Files        []TailedFile
+	Streams      []string
+	// Command is what `squirrel run` wraps, it is empty when squirrel reads stdin
+	Command []string
+	PTY     bool
+	// ParseJSON makes the broadcaster send the fields of JSON lines along with the line
+	ParseJSON bool
+	// Multiline groups lines like stack traces into a single record before sending them
+	Multiline MultilineOptions
+	// Lines are sent in batches of up to BatchSize lines, waiting BatchInterval at most for a batch to fill
+	BatchSize     int
+	BatchInterval time.Duration
+	// Compression asks the server for permessage-deflate, it is only used if the server agrees
+	Compression      bool
+	CompressionLevel int
+	// StripColors is resolved from --color, listeners strip escape sequences from lines when it is set
+	StripColors bool
+	// Filter is sent to the server in listen mode so only matching lines are received
+	Filter *common.FilterMessage
+	// SlowPolicy is what the server does once this listener can't keep up, empty for the server default
+	SlowPolicy string
+	// Admin is the command and arguments of `squirrel admin`, it is empty otherwise
+	Admin      []string
+	AdminToken string
+	// TLS trusts a custom CA bundle and presents a client certificate, it is nil to use the system defaults
+	TLS *tls.Config
 }
 
 const (
 	DEFAULT_ENVIRONMENT = "prod"
 	DEFAULT_DOMAIN      = "localhost:3000"
 	DEFAULT_LOG_LEVEL   = "error"
+	COLOR_AUTO          = "auto"
+	COLOR_ALWAYS        = "always"
+	COLOR_NEVER         = "never"
+	// Fastest level, log lines compress well enough without spending more CPU on every message
+	DEFAULT_COMPRESSION_LEVEL = "1"
 )
 
 var (
-	env          string
-	domain       string
-	loglevel     string
-	peer         string
-	listen       bool
-	output       bool
-	urlClipboard bool
+	env               string
+	domain            string
+	serverUrl         string
+	loglevel          string
+	peer              string
+	token             string
+	id                string
+	secret            string
+	listen            bool
+	output            bool
+	urlClipboard      bool
+	noWait            bool
+	stream            string
+	slowPolicy        string
+	files             fileList
+	streams           string
+	ptyMode           bool
+	parseJSON         bool
+	multiline         string
+	multilineIndent   bool
+	multilineMaxLines string
+	multilineTimeout  string
+	batchSize         string
+	batchInterval     string
+	compression       bool
+	compressionLevel  string
+	adminToken        string
+	caCert            string
+	tlsCert           string
+	tlsKey            string
+	color             string
+	include           stringList
+	exclude           stringList
+	contains          stringList
+	fields            stringList
+	level             string
 )
 
+// stringList collects the values of a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func fprintf(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 }
@@ -43,29 +125,185 @@ func InitOptions() *ClientOptions {
 	flag.Usage = func() {
 		fprintf("Usage of %s:\n", os.Args[0])
 		fprintf(" %s [options]\n", os.Args[0])
+		fprintf(" %s %s [options] -- <command> [args...]\n", os.Args[0], RUN_COMMAND)
+		fprintf(" %s %s [options] <list|inspect|kill|evict> [args...]\n", os.Args[0], ADMIN_COMMAND)
 		fprintf("Options:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.StringVar(&env, "env", common.WinningDefault(common.GetEnvVariable("APP_ENV"), env, DEFAULT_ENVIRONMENT), "Client environment (prod|dev)")
 	flag.StringVar(&domain, "domain", common.WinningDefault(common.GetEnvVariable("DOMAIN"), domain, DEFAULT_DOMAIN), "Server domain")
+	flag.StringVar(&serverUrl, "server", common.GetEnvVariable("SERVER_URL"), "Full URL of the server e.g. https://logs.corp:8443/squirrel, it takes over --domain and --env")
 	flag.StringVar(&loglevel, "log", common.WinningDefault(common.GetEnvVariable("LOG_LEVEL"), loglevel, DEFAULT_LOG_LEVEL), "Log level")
 	flag.StringVar(&peer, "peer", "", "Peer client ID")
+	flag.StringVar(&token, "token", common.GetEnvVariable("SQUIRREL_TOKEN"), "Read token of the peer session (required in listen mode)")
 	flag.BoolVar(&listen, "listen", false, "Initiate in listen mode to listen to peer")
 	flag.BoolVar(&listen, "l", false, "Initiate in listen mode to listen to peer")
 	flag.BoolVar(&output, "show-output", false, "Print output stream to stdout")
 	flag.BoolVar(&output, "o", false, "Print output stream to stdout")
 	flag.BoolVar(&urlClipboard, "copy-url", false, "Copy shareable link to clipboard")
 	flag.BoolVar(&urlClipboard, "u", false, "Copy shareable link to clipboard")
-	flag.Parse()
+	flag.BoolVar(&noWait, "no-wait", false, "Start piping stdin right away instead of waiting for the first listener")
+	flag.BoolVar(&noWait, "n", false, "Start piping stdin right away instead of waiting for the first listener")
+	flag.StringVar(&id, "id", "", "Broadcaster ID to reuse instead of generating a new one (requires --secret if it was used before)")
+	flag.StringVar(&secret, "secret", common.GetEnvVariable("SQUIRREL_SECRET"), "Secret that was issued for the broadcaster ID when it was first used")
+	flag.StringVar(&stream, "stream", "", "Stream name of the lines piped to stdin")
+	flag.Var(&files, "file", "File to tail on its own stream, use stream=path to name the stream (can be repeated)")
+	flag.BoolVar(&ptyMode, "pty", false, "Run the command in a pseudo-terminal and share the terminal as is (only with run)")
+	flag.BoolVar(&parseJSON, "json", false, "Send the level, time, message and other fields of JSON lines so they can be shown as a table")
+	flag.StringVar(&multiline, "multiline", "", "Regular expression of lines that belong to the line before them e.g. '^\\s+at ' for Java stack traces")
+	flag.BoolVar(&multilineIndent, "multiline-indent", false, "Indented lines belong to the line before them")
+	flag.StringVar(&multilineMaxLines, "multiline-max-lines", DEFAULT_MULTILINE_MAX_LINES, "Maximum number of lines grouped together (0 means no limit)")
+	flag.StringVar(&multilineTimeout, "multiline-timeout", DEFAULT_MULTILINE_TIMEOUT, "How long grouped lines wait for the next line before being sent")
+	flag.StringVar(&batchSize, "batch-size", DEFAULT_BATCH_SIZE, "Maximum number of lines sent in a single message (1 sends every line on its own)")
+	flag.StringVar(&batchInterval, "batch-interval", DEFAULT_BATCH_INTERVAL, "How long lines wait for more lines to be sent with")
+	flag.BoolVar(&compression, "compression", true, "Compress messages if the server supports permessage-deflate")
+	flag.StringVar(&compressionLevel, "compression-level", DEFAULT_COMPRESSION_LEVEL, "Compression level from -2 (huffman only) to 9 (best compression)")
+	flag.StringVar(&color, "color", COLOR_AUTO, "Show colors of received lines in listen mode (auto|always|never), auto only shows them if stdout is a terminal")
+	flag.Var(&include, "include", "Only receive lines matching this regular expression in listen mode (can be repeated)")
+	flag.Var(&exclude, "exclude", "Don't receive lines matching this regular expression in listen mode (can be repeated)")
+	flag.Var(&contains, "contains", "Only receive lines containing this text in listen mode (can be repeated)")
+	flag.Var(&fields, "field", "Only receive JSON lines matching this predicate in listen mode e.g. status>=500 (can be repeated)")
+	flag.StringVar(&level, "level", "", "Only receive lines of this level or higher in listen mode (trace|debug|info|warn|error|fatal)")
+	flag.StringVar(&slowPolicy, "slow-policy", "", "What the server does once this listener can't keep up in listen mode (drop_oldest|drop_newest|disconnect), the server default is used if empty")
+	flag.StringVar(&adminToken, "admin-token", common.GetEnvVariable("SQUIRREL_ADMIN_TOKEN"), "Token of the server admin API (only with admin)")
+	flag.StringVar(&caCert, "ca-cert", "", "PEM CA bundle to trust on top of the system CAs when connecting to the server")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM client certificate presented to servers that require one from broadcasters (requires --tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key of the client certificate")
+	flag.StringVar(&streams, "streams", "", "Comma separated streams to show in listen mode, all streams are shown if empty")
+
+	args := os.Args[1:]
+	run := len(args) > 0 && args[0] == RUN_COMMAND
+	admin := len(args) > 0 && args[0] == ADMIN_COMMAND
+
+	if run || admin {
+		args = args[1:]
+	}
+
+	// Errors are handled by the flag set itself, it exits on invalid flags
+	_ = flag.CommandLine.Parse(args)
+
+	var command []string
+
+	if run {
+		command = flag.Args()
+
+		if len(command) == 0 {
+			fprintf("Missing command to run\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	var adminCommand []string
+
+	if admin {
+		adminCommand = flag.Args()
+
+		if len(adminCommand) == 0 {
+			adminUsage()
+			os.Exit(2)
+		}
+	}
 
 	return &ClientOptions{
 		Env:          env,
-		Domain:       common.BuildDomain(domain, env),
+		Domain:       serverDomain(serverUrl, domain, env),
 		LogLevel:     common.GetLogLevelFromString(loglevel),
 		PeerId:       peer,
+		Token:        token,
+		Id:           id,
+		Secret:       secret,
 		Listen:       listen,
 		Output:       output,
 		UrlClipboard: urlClipboard,
+		NoWait:       noWait,
+		Stream:       stream,
+		Files:        files,
+		Streams:      common.SplitList(streams),
+		Command:      command,
+		PTY:          ptyMode,
+		ParseJSON:    parseJSON,
+		Multiline: MultilineOptions{
+			Pattern:  multilinePattern(multiline),
+			Indent:   multilineIndent,
+			MaxLines: common.StrToInt(multilineMaxLines),
+			Timeout:  common.StrToDuration(multilineTimeout),
+		},
+		BatchSize:        common.StrToInt(batchSize),
+		BatchInterval:    common.StrToDuration(batchInterval),
+		Compression:      compression,
+		CompressionLevel: parseCompressionLevel(compressionLevel),
+		StripColors:      stripColors(color),
+		Filter: &common.FilterMessage{
+			Include:  include,
+			Exclude:  exclude,
+			Contains: contains,
+			Fields:   fields,
+			Level:    level,
+		},
+		SlowPolicy: slowPolicy,
+		Admin:      adminCommand,
+		AdminToken: adminToken,
+		TLS:        tlsConfig(caCert, tlsCert, tlsKey),
 	}
 }
+
+// stripColors resolves --color, NO_COLOR is respected in auto mode (https://no-color.org)
+func stripColors(color string) bool {
+	switch color {
+	case COLOR_ALWAYS:
+		return false
+	case COLOR_NEVER:
+		return true
+	case COLOR_AUTO:
+		return os.Getenv("NO_COLOR") != "" || !term.IsTerminal(int(os.Stdout.Fd()))
+	}
+
+	fprintf("Invalid --color value: [%s], it must be one of %s, %s or %s\n", color, COLOR_AUTO, COLOR_ALWAYS, COLOR_NEVER)
+	os.Exit(2)
+
+	return false
+}
+
+// serverDomain uses the URL of --server when it is set, the scheme only depends on the environment otherwise
+func serverDomain(serverUrl string, domain string, env string) *common.Domain {
+	if serverUrl == "" {
+		return common.BuildDomain(domain, "", env == "prod")
+	}
+
+	serverDomain, err := common.ParseServerURL(serverUrl)
+
+	if err != nil {
+		fprintf("Invalid --server: %s\n", err)
+		os.Exit(2)
+	}
+
+	return serverDomain
+}
+
+func parseCompressionLevel(value string) int {
+	level := common.StrToInt(value)
+
+	if !common.IsValidCompressionLevel(level) {
+		fprintf("Invalid --compression-level: [%d], it must be between -2 and 9\n", level)
+		os.Exit(2)
+	}
+
+	return level
+}
+
+func multilinePattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+
+	if err != nil {
+		fprintf("Invalid --multiline pattern: %s\n", err)
+		os.Exit(2)
+	}
+
+	return compiled
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+// Pending keeps lines and terminal frames that were sent but not acknowledged by the server yet
+// so they can be sent again once squirrel reconnects
+type Pending struct {
+	messages []common.Message
+	max      int
+}
+
+func NewPending(max int) *Pending {
+	return &Pending{
+		max: max,
+	}
+}
+
+// messageSeq returns the sequence of a queued line or terminal frame
+func messageSeq(message common.Message) uint64 {
+	switch payload := message.Payload.(type) {
+	case common.LogMessage:
+		return payload.Seq
+	case common.TermFrameMessage:
+		return payload.Seq
+	}
+
+	return 0
+}
+
+// withSeq numbers a queued line or terminal frame
+func withSeq(message common.Message, seq uint64) common.Message {
+	switch payload := message.Payload.(type) {
+	case common.LogMessage:
+		payload.Seq = seq
+		message.Payload = payload
+	case common.TermFrameMessage:
+		payload.Seq = seq
+		message.Payload = payload
+	}
+
+	return message
+}
+
+func (p *Pending) Add(message common.Message) {
+	p.messages = append(p.messages, message)
+
+	if len(p.messages) > p.max {
+		zap.S().Warnw("Too many lines are waiting to be acknowledged, dropping oldest line", "seq", messageSeq(p.messages[0]))
+		p.messages = p.messages[1:]
+	}
+}
+
+// Acknowledge releases everything up to seq
+func (p *Pending) Acknowledge(seq uint64) {
+	i := 0
+
+	for i < len(p.messages) && messageSeq(p.messages[i]) <= seq {
+		i++
+	}
+
+	p.messages = p.messages[i:]
+}
+
+func (p *Pending) Messages() []common.Message {
+	return p.messages
+}
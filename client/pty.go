@@ -0,0 +1,180 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+const (
+	// Size of the pseudo-terminal when squirrel itself isn't running in a terminal
+	DEFAULT_TERMINAL_COLS = 80
+	DEFAULT_TERMINAL_ROWS = 24
+	// Biggest chunk of terminal output sent in a single frame
+	MAX_FRAME_SIZE = 32 * 1024
+)
+
+// frameSize is how much terminal output fits in a frame the server accepts, it is base64 encoded
+// so it grows by a third once marshaled
+func frameSize() int {
+	size := messageLimit() / 4 * 3
+
+	if size <= 0 || size > MAX_FRAME_SIZE {
+		return MAX_FRAME_SIZE
+	}
+
+	return size
+}
+
+// terminalSize is shared between the resize handler and the frame reader
+// the reader announces the size on the next frame once it changed
+type terminalSize struct {
+	mutex   sync.Mutex
+	cols    uint16
+	rows    uint16
+	changed bool
+}
+
+func (s *terminalSize) set(cols uint16, rows uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cols, s.rows, s.changed = cols, rows, true
+}
+
+func (s *terminalSize) take() (uint16, uint16, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := s.changed
+	s.changed = false
+
+	return s.cols, s.rows, changed
+}
+
+// runInTerminal runs the command in a pseudo-terminal, its raw output is sent as terminal frames
+// while the local terminal keeps driving the command just like it was run directly
+func runInTerminal(cmd *exec.Cmd) error {
+	ptmx, err := pty.Start(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	defer ptmx.Close()
+
+	startedAt := time.Now()
+
+	// Command runs in a session of its own so terminal signals never reach it directly
+	stopForwarding := forwardSignals(cmd.Process, true)
+	defer stopForwarding()
+
+	size := &terminalSize{}
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+
+	resize := func() {
+		if interactive {
+			if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
+				zap.L().Warn("Error resizing pseudo-terminal", zap.Error(err))
+			}
+		} else {
+			_ = pty.Setsize(ptmx, &pty.Winsize{Cols: DEFAULT_TERMINAL_COLS, Rows: DEFAULT_TERMINAL_ROWS})
+		}
+
+		winsize, err := pty.GetsizeFull(ptmx)
+
+		if err == nil {
+			size.set(winsize.Cols, winsize.Rows)
+		}
+	}
+
+	resize()
+
+	resizes := make(chan os.Signal, 1)
+	signal.Notify(resizes, syscall.SIGWINCH)
+
+	defer func() {
+		signal.Stop(resizes)
+		close(resizes)
+	}()
+
+	go func() {
+		for range resizes {
+			resize()
+		}
+	}()
+
+	if interactive {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+
+		if err != nil {
+			zap.L().Warn("Error switching terminal to raw mode", zap.Error(err))
+		} else {
+			defer func() {
+				_ = term.Restore(int(os.Stdin.Fd()), state)
+			}()
+		}
+
+		go func() {
+			_, _ = io.Copy(ptmx, os.Stdin)
+		}()
+	}
+
+	buffer := make([]byte, MAX_FRAME_SIZE)
+
+	for {
+		n, err := ptmx.Read(buffer)
+
+		if n > 0 {
+			// Local terminal shows the command output no matter what, it is interactive
+			_, _ = os.Stdout.Write(buffer[:n])
+
+			offset := time.Since(startedAt).Milliseconds()
+
+			// Output is split in frames the server accepts, they're replayed one after the other
+			for data, limit := buffer[:n], frameSize(); len(data) > 0; {
+				chunk := data
+
+				if len(chunk) > limit {
+					chunk = chunk[:limit]
+				}
+
+				data = data[len(chunk):]
+
+				frame := common.TermFrameMessage{
+					Data:   append([]byte(nil), chunk...),
+					Offset: offset,
+				}
+
+				if cols, rows, changed := size.take(); changed {
+					frame.Cols, frame.Rows = cols, rows
+				}
+
+				input <- common.Message{
+					Id:      clientId,
+					Event:   common.EVENT_TERM_FRAME,
+					Payload: frame,
+				}
+			}
+		}
+
+		// Reading fails with EIO once the command exits and the terminal is closed
+		if err != nil {
+			break
+		}
+	}
+
+	return cmd.Wait()
+}
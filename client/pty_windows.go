@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func runInTerminal(cmd *exec.Cmd) error {
+	return errors.New("pseudo-terminal mode is not supported on windows")
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+const (
+	RUN_COMMAND   = "run"
+	STREAM_STDOUT = "stdout"
+	STREAM_STDERR = "stderr"
+	// How long squirrel waits for the server to confirm the process exit before exiting anyway
+	EXIT_FLUSH_TIMEOUT = 5 * time.Second
+	// Exit code used by shells when a command can't be found or executed
+	EXIT_CODE_NOT_STARTED = 127
+)
+
+var (
+	// exits hands the process exit to the sender, after every line of the command
+	exits = make(chan common.ProcessExitMessage)
+	// exitConfirmations is notified once the server sends the process exit back
+	exitConfirmations = make(chan struct{}, 1)
+	// processExits tells the main loop which code squirrel has to exit with
+	processExits = make(chan int, 1)
+	// Start of the last process exit a listener printed, exits are replayed after reconnecting
+	printedExit time.Time
+	// Signals that are passed to the command instead of stopping squirrel
+	forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+	// Signals the terminal sends to its whole foreground process group, which the command is part of
+	terminalSignals = []os.Signal{os.Interrupt, syscall.SIGQUIT}
+)
+
+// RunCommand starts the command with its stdout and stderr sent on their own streams
+// once it exits the process exit is published and squirrel exits with the same code
+func RunCommand(command []string) {
+	exit := common.ProcessExitMessage{
+		Command:   strings.Join(command, " "),
+		StartedAt: time.Now().UTC(),
+	}
+
+	err := runCommand(command)
+
+	exit.FinishedAt = time.Now().UTC()
+	exit.Duration = exit.FinishedAt.Sub(exit.StartedAt).Milliseconds()
+
+	code := setExitStatus(&exit, err)
+
+	zap.S().Infow("Command exited", "command", exit.Command, "exitCode", exit.ExitCode, "signal", exit.Signal, "error", exit.Error)
+
+	if exit.Error != "" {
+		fmt.Fprintf(os.Stderr, "✖ Couldn't run command: %s\n", exit.Error)
+	}
+
+	exits <- exit
+
+	select {
+	case <-exitConfirmations:
+	case <-time.After(EXIT_FLUSH_TIMEOUT):
+		fmt.Fprintln(os.Stderr, "⚠ Server didn't confirm the command exit in time, some lines may not have been sent")
+	}
+
+	processExits <- code
+}
+
+func runCommand(command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+
+	if options.PTY {
+		return runInTerminal(cmd)
+	}
+
+	cmd.Stdin = os.Stdin
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		return err
+	}
+
+	// Command shares the process group of squirrel, it already gets Ctrl+C from the terminal
+	stopForwarding := forwardSignals(cmd.Process, false)
+	defer stopForwarding()
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		ScanStream(stdout, STREAM_STDOUT, os.Stdout)
+	}()
+
+	go func() {
+		defer wg.Done()
+		ScanStream(stderr, STREAM_STDERR, os.Stderr)
+	}()
+
+	// Pipes must be read till the end before waiting, otherwise the last lines are lost
+	wg.Wait()
+
+	return cmd.Wait()
+}
+
+// setExitStatus fills how the command ended and returns the code squirrel should exit with
+func setExitStatus(exit *common.ProcessExitMessage, err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitError *exec.ExitError
+
+	if !errors.As(err, &exitError) {
+		exit.ExitCode = EXIT_CODE_NOT_STARTED
+		exit.Error = err.Error()
+		return EXIT_CODE_NOT_STARTED
+	}
+
+	exit.ExitCode = exitError.ExitCode()
+
+	if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit.Signal = status.Signal().String()
+		// Same as shells, a command killed by a signal exits with 128 + signal number
+		return 128 + int(status.Signal())
+	}
+
+	return exit.ExitCode
+}
+
+// forwardSignals passes signals squirrel gets to the command until stop is called, terminal signals
+// are only passed if the command is in a process group of its own, otherwise it would get them twice
+func forwardSignals(process *os.Process, terminal bool) (stop func()) {
+	// Main loop must not stop on these signals anymore, the command decides what to do with them
+	signal.Stop(interrupt)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+
+	go func() {
+		for sig := range signals {
+			if !terminal && isTerminalSignal(sig) {
+				zap.S().Debugw("Command got the signal from the terminal already", "signal", sig)
+				continue
+			}
+
+			zap.S().Debugw("Forwarding signal to command", "signal", sig)
+
+			if err := process.Signal(sig); err != nil {
+				zap.L().Warn("Error forwarding signal to command", zap.Error(err))
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+func isTerminalSignal(sig os.Signal) bool {
+	for _, terminalSignal := range terminalSignals {
+		if sig == terminalSignal {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printProcessExit shows how the command of the broadcaster ended to a listener
+func printProcessExit(exit common.ProcessExitMessage) {
+	if exit.StartedAt.Equal(printedExit) {
+		return
+	}
+
+	printedExit = exit.StartedAt
+	duration := (time.Duration(exit.Duration) * time.Millisecond).String()
+
+	switch {
+	case exit.Error != "":
+		fmt.Fprintf(os.Stderr, "✖ `%s` couldn't be started: %s\n", exit.Command, exit.Error)
+	case exit.Signal != "":
+		fmt.Fprintf(os.Stderr, "✖ `%s` was killed by signal [%s] after %s\n", exit.Command, exit.Signal, duration)
+	case exit.Succeeded():
+		fmt.Fprintf(os.Stderr, "✔ `%s` exited with code [0] after %s\n", exit.Command, duration)
+	default:
+		fmt.Fprintf(os.Stderr, "✖ `%s` exited with code [%d] after %s\n", exit.Command, exit.ExitCode, duration)
+	}
+}
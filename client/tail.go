@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often tailed files are checked for new lines, truncation or rotation
+const TAIL_POLL_INTERVAL = 250 * time.Millisecond
+
+// TailedFile is a file passed with --file, its lines are sent on their own stream
+type TailedFile struct {
+	Stream string
+	Path   string
+}
+
+// fileList collects repeated --file flags, each one is either a path or stream=path
+type fileList []TailedFile
+
+func (f *fileList) String() string {
+	var files []string
+
+	for _, file := range *f {
+		files = append(files, fmt.Sprintf("%s=%s", file.Stream, file.Path))
+	}
+
+	return strings.Join(files, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	stream, path := "", value
+
+	if i := strings.Index(value, "="); i > 0 {
+		stream, path = value[:i], value[i+1:]
+	}
+
+	if path == "" {
+		return fmt.Errorf("file path can't be empty")
+	}
+
+	if stream == "" {
+		stream = filepath.Base(path)
+	}
+
+	*f = append(*f, TailedFile{
+		Stream: stream,
+		Path:   path,
+	})
+
+	return nil
+}
+
+// TailFile follows the file like `tail -F`, only lines written after squirrel started are sent
+// it keeps following the path when the file is truncated or replaced by log rotation
+func TailFile(file TailedFile) {
+	var reader *bufio.Reader
+	var current *os.File
+	var offset int64
+	var partial string
+
+	lines := newLineGrouper(file.Stream)
+
+	open := func(fromEnd bool) {
+		f, err := os.Open(file.Path)
+
+		if err != nil {
+			return
+		}
+
+		offset = 0
+
+		if fromEnd {
+			offset, err = f.Seek(0, io.SeekEnd)
+
+			if err != nil {
+				f.Close()
+				return
+			}
+		}
+
+		if current != nil {
+			current.Close()
+		}
+
+		current = f
+		reader = bufio.NewReader(f)
+		partial = ""
+	}
+
+	open(true)
+
+	if current == nil {
+		zap.S().Warnw("File doesn't exist yet, waiting for it", "path", file.Path)
+	}
+
+	for {
+		if current == nil {
+			time.Sleep(TAIL_POLL_INTERVAL)
+			open(false)
+			continue
+		}
+
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+
+		if err == nil {
+			line = partial + strings.TrimRight(line, "\r\n")
+			echoLine(line, os.Stdout)
+			lines.Add(line, false)
+			partial = ""
+			continue
+		}
+
+		// Keep what was read so far, the rest of the line wasn't written yet
+		partial += line
+
+		if err != io.EOF {
+			zap.L().Error("Error reading tailed file", zap.String("path", file.Path), zap.Error(err))
+		}
+
+		time.Sleep(TAIL_POLL_INTERVAL)
+
+		info, err := os.Stat(file.Path)
+
+		if err != nil {
+			// File was moved away, wait for the new one to show up
+			continue
+		}
+
+		currentInfo, err := current.Stat()
+
+		if err != nil || !os.SameFile(info, currentInfo) {
+			zap.S().Infow("Tailed file was rotated, reopening it", "path", file.Path)
+			open(false)
+			continue
+		}
+
+		if info.Size() < offset {
+			zap.S().Infow("Tailed file was truncated, reading it from the beginning", "path", file.Path)
+			open(false)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+// tlsConfig trusts the CA bundle on top of the system CAs and presents the client certificate
+// to servers that require one from broadcasters, it is nil when none of them is set
+func tlsConfig(caCert string, cert string, key string) *tls.Config {
+	if caCert == "" && cert == "" && key == "" {
+		return nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caCert != "" {
+		pool, err := x509.SystemCertPool()
+
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if err := common.AppendCertsFromFile(pool, caCert); err != nil {
+			fprintf("Invalid --ca-cert: %s\n", err)
+			os.Exit(2)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if cert == "" && key == "" {
+		return config
+	}
+
+	if cert == "" || key == "" {
+		fprintf("Both --tls-cert and --tls-key must be set to present a client certificate\n")
+		os.Exit(2)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+
+	if err != nil {
+		fprintf("Invalid client certificate: %s\n", err)
+		os.Exit(2)
+	}
+
+	config.Certificates = []tls.Certificate{certificate}
+
+	return config
+}
@@ -4,11 +4,13 @@ go 1.17
 
 require (
 	github.com/atotto/clipboard v0.1.4
+	github.com/creack/pty v1.1.21
 	github.com/gin-gonic/gin v1.7.7
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/inancgumus/screen v0.0.0-20190314163918-06e984b86ed3
 	go.uber.org/zap v1.21.0
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
 
 require (
@@ -27,6 +29,5 @@ require (
 	go.uber.org/multierr v1.6.0 // indirect
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292 // indirect
 	golang.org/x/sys v0.0.0-20220227234510-4e6760a101f9 // indirect
-	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,35 @@
+package common
+
+import "time"
+
+// SessionInfo is what the admin API of squirreld tells about a session
+type SessionInfo struct {
+	Id        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeq   uint64    `json:"lastSeq"`
+	// Bytes of lines and terminal frames the broadcaster published
+	Bytes uint64 `json:"bytes"`
+	// Broadcaster is nil while the session waits for its broadcaster to reconnect
+	Broadcaster     *PeerInfo           `json:"broadcaster,omitempty"`
+	SubscriberCount int                 `json:"subscriberCount"`
+	Subscribers     []PeerInfo          `json:"subscribers,omitempty"`
+	Exit            *ProcessExitMessage `json:"exit,omitempty"`
+}
+
+// PeerInfo is what the admin API tells about a connected broadcaster or subscriber
+type PeerInfo struct {
+	Id          string    `json:"id"`
+	Address     string    `json:"address"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Version     int       `json:"version"`
+	// Certificate is the common name of the client certificate, only set with mutual TLS
+	Certificate string `json:"certificate,omitempty"`
+	// BytesReceived and BytesSent are websocket messages read from and written to the peer
+	BytesReceived uint64 `json:"bytesReceived"`
+	BytesSent     uint64 `json:"bytesSent"`
+	Dropped       uint64 `json:"dropped"`
+	// Acked is the last line a subscriber acknowledged and Lag how many lines it is behind the
+	// session, both are only set for subscribers that send acks
+	Acked uint64 `json:"acked,omitempty"`
+	Lag   uint64 `json:"lag,omitempty"`
+}
@@ -0,0 +1,12 @@
+package common
+
+import "regexp"
+
+// Matches CSI sequences (colors, cursor movement...), OSC sequences (window title, links...)
+// and the remaining two characters escape sequences
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// StripANSI removes terminal escape sequences from s
+func StripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
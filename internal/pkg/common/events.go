@@ -0,0 +1,125 @@
+package common
+
+const (
+	// PROTOCOL_VERSION must be bumped whenever peers of different versions can't understand each other
+	PROTOCOL_VERSION = 2
+	// Oldest protocol version that is still supported, version 1 peers don't send hello at all
+	MIN_PROTOCOL_VERSION = 1
+)
+
+// Events exchanged between squirrel, squirreld and the web view
+const (
+	EVENT_HELLO           = "hello"
+	EVENT_IDENTITY        = "identity"
+	EVENT_SESSION         = "session"
+	EVENT_LOG_LINE        = "log_line"
+	EVENT_LOG_LINES       = "log_lines"
+	EVENT_LOG_ACK         = "log_ack"
+	EVENT_SUBSCRIBER_ACK  = "subscriber_ack"
+	EVENT_ERROR           = "error"
+	EVENT_PROCESS_EXIT    = "process_exit"
+	EVENT_TERM_FRAME      = "term_frame"
+	EVENT_LINES_SKIPPED   = "lines_skipped"
+	EVENT_SERVER_SHUTDOWN = "server_shutdown"
+)
+
+// Codes of error events
+const (
+	ERROR_ID_TAKEN             = "id_taken"
+	ERROR_INVALID_SECRET       = "invalid_secret"
+	ERROR_UNAUTHORIZED         = "unauthorized"
+	ERROR_NOT_FOUND            = "not_found"
+	ERROR_INCOMPATIBLE_VERSION = "incompatible_version"
+	ERROR_INVALID_FILTER       = "invalid_filter"
+	ERROR_INVALID_POLICY       = "invalid_policy"
+	// Session or subscriber was disconnected through the admin API
+	ERROR_TERMINATED = "terminated"
+)
+
+// Optional features peers announce in their hello, a feature is only used when both sides have it
+const (
+	// Lines are numbered so they can be resent or replayed after reconnecting
+	CAPABILITY_RESUME = "resume"
+	// Receivers acknowledge the lines they got
+	CAPABILITY_ACKS = "acks"
+	// Receivers can render raw terminal frames of broadcasters running in a pseudo-terminal
+	CAPABILITY_TERMINAL = "terminal"
+	// Broadcasters send lines in batches of log_lines instead of a log_line each
+	CAPABILITY_BATCH = "batch"
+)
+
+var events = map[string]bool{
+	EVENT_HELLO:           true,
+	EVENT_IDENTITY:        true,
+	EVENT_SESSION:         true,
+	EVENT_LOG_LINE:        true,
+	EVENT_LOG_LINES:       true,
+	EVENT_LOG_ACK:         true,
+	EVENT_SUBSCRIBER_ACK:  true,
+	EVENT_ERROR:           true,
+	EVENT_PROCESS_EXIT:    true,
+	EVENT_TERM_FRAME:      true,
+	EVENT_LINES_SKIPPED:   true,
+	EVENT_SERVER_SHUTDOWN: true,
+}
+
+// Capabilities are the features supported by this build
+var Capabilities = []string{
+	CAPABILITY_RESUME,
+	CAPABILITY_ACKS,
+	CAPABILITY_TERMINAL,
+	CAPABILITY_BATCH,
+}
+
+func IsKnownEvent(event string) bool {
+	return events[event]
+}
+
+// NegotiateVersion picks the newest version supported by both this build and the peer
+func NegotiateVersion(hello HelloMessage) (int, bool) {
+	version := hello.Version
+
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+
+	minVersion := hello.MinVersion
+
+	if minVersion == 0 || minVersion > hello.Version {
+		minVersion = hello.Version
+	}
+
+	if minVersion < MIN_PROTOCOL_VERSION {
+		minVersion = MIN_PROTOCOL_VERSION
+	}
+
+	return version, version >= minVersion
+}
+
+func NewHelloMessage() HelloMessage {
+	return HelloMessage{
+		Version:      PROTOCOL_VERSION,
+		MinVersion:   MIN_PROTOCOL_VERSION,
+		Capabilities: Capabilities,
+	}
+}
+
+// NegotiateCapabilities returns capabilities that both sides support
+func NegotiateCapabilities(ours []string, theirs []string) []string {
+	var negotiated []string
+
+	for _, capability := range ours {
+		for _, other := range theirs {
+			if capability == other {
+				negotiated = append(negotiated, capability)
+				break
+			}
+		}
+	}
+
+	return negotiated
+}
+
+func HasCapability(capabilities []string, capability string) bool {
+	return Contains(capabilities, capability)
+}
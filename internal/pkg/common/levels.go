@@ -0,0 +1,82 @@
+package common
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Log levels ordered by severity, they're used to filter lines by their minimum level
+const (
+	LEVEL_TRACE = iota + 1
+	LEVEL_DEBUG
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+	LEVEL_FATAL
+)
+
+var levels = map[string]int{
+	"trace":    LEVEL_TRACE,
+	"debug":    LEVEL_DEBUG,
+	"info":     LEVEL_INFO,
+	"warn":     LEVEL_WARN,
+	"warning":  LEVEL_WARN,
+	"error":    LEVEL_ERROR,
+	"err":      LEVEL_ERROR,
+	"fatal":    LEVEL_FATAL,
+	"panic":    LEVEL_FATAL,
+	"critical": LEVEL_FATAL,
+}
+
+// Fields structured loggers usually keep the level in
+var levelFields = []string{"level", "lvl", "severity"}
+
+var levelPattern = regexp.MustCompile(`(?i)\b(trace|debug|info|warn|warning|error|err|fatal|panic|critical)\b`)
+
+// ParseLevel returns the severity of a level name like `warn` or `ERROR`
+func ParseLevel(name string) (int, bool) {
+	level, ok := levels[strings.ToLower(strings.TrimSpace(name))]
+
+	return level, ok
+}
+
+// LineLevel finds the level of a line, either from the level field of a JSON line
+// or from the first level name that shows up in a plain text line
+func LineLevel(line string) (int, bool) {
+	var fields map[string]interface{}
+
+	if json.Unmarshal([]byte(line), &fields) == nil {
+		return FieldsLevel(fields)
+	}
+
+	return TextLevel(line)
+}
+
+// FieldsLevel finds the level in the fields of a JSON line that is already decoded
+func FieldsLevel(fields map[string]interface{}) (int, bool) {
+	for _, field := range levelFields {
+		switch value := fields[field].(type) {
+		case string:
+			return ParseLevel(value)
+		case float64:
+			// Numeric levels of pino and bunyan: 10 is trace and 60 is fatal
+			if value >= 10 && value <= 60 {
+				return int(value) / 10, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// TextLevel finds the first level name that shows up in a plain text line
+func TextLevel(line string) (int, bool) {
+	match := levelPattern.FindString(line)
+
+	if match == "" {
+		return 0, false
+	}
+
+	return ParseLevel(match)
+}
@@ -2,11 +2,18 @@ package common
 
 import (
 	"encoding/json"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// DEFAULT_STREAM is how lines without a stream are referred to when filtering streams
+const DEFAULT_STREAM = "stdin"
+
+// TERMINAL_STREAM is the stream of terminal frames, so they can be told apart from lines when exporting
+const TERMINAL_STREAM = "tty"
+
 type Message struct {
 	Id      string      `json:"id"`
 	Payload interface{} `json:"payload"`
@@ -15,19 +22,151 @@ type Message struct {
 
 type LogMessage struct {
 	Line string `json:"line"`
+	// Seq is numbered by the broadcaster starting from the last sequence its session has
+	// so lines can be resent after reconnecting without being duplicated
+	Seq uint64 `json:"seq,omitempty"`
+	// Stream names the source of the line (e.g. stdout, stderr or a tailed file), lines piped to stdin have no stream
+	Stream string `json:"stream,omitempty"`
+	// Time is set by the server when the line was received, broadcasters leave it empty
+	Time *time.Time `json:"time,omitempty"`
+	// Structured is set by the broadcaster when the line is a JSON object
+	Structured *StructuredLog `json:"structured,omitempty"`
+	// Truncated is set by the broadcaster when the line was cut to fit in a message of the server
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// StreamName is the stream of the line, lines without one belong to DEFAULT_STREAM
+func (m LogMessage) StreamName() string {
+	return WinningDefault(m.Stream, DEFAULT_STREAM)
+}
+
+// LogLinesMessage is a batch of lines sent in a single frame, lines keep their own sequence
+type LogLinesMessage struct {
+	Lines []LogMessage `json:"lines"`
+}
+
+// HelloMessage is the first message peers exchange, before identity
+// the server replies with the version both sides are going to speak
+type HelloMessage struct {
+	Version int `json:"version"`
+	// MinVersion is the oldest version the peer can fall back to, it is Version if not set
+	MinVersion   int      `json:"minVersion,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	// MaxMessageSize is the largest message the server reads, batches are kept under it
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"`
 }
 
 type IdentityMessage struct {
 	PeerId      string `json:"peerId"`
 	Broadcaster bool   `json:"broadcaster"`
 	Subscriber  bool   `json:"subscriber"`
+	Token       string `json:"token,omitempty"`
+	Secret      string `json:"secret,omitempty"`
+	// Since is the last sequence a subscriber received, only newer lines are replayed to it
+	Since uint64 `json:"since,omitempty"`
+	// Filter is evaluated by the server so subscribers only receive lines they care about
+	Filter *FilterMessage `json:"filter,omitempty"`
+	// SlowPolicy is what the server does once the subscriber can't keep up, its default is used when empty
+	SlowPolicy string `json:"slowPolicy,omitempty"`
+}
+
+// FilterMessage describes which lines a subscriber wants, a line must pass every set condition
+type FilterMessage struct {
+	// Include regular expressions, a line must match at least one of them
+	Include []string `json:"include,omitempty"`
+	// Exclude regular expressions, a line must not match any of them
+	Exclude []string `json:"exclude,omitempty"`
+	// Contains substrings, a line must contain all of them
+	Contains []string `json:"contains,omitempty"`
+	// Fields predicates on JSON lines like `level=error`, `status>=500` or `msg~timeout`
+	Fields []string `json:"fields,omitempty"`
+	// Level is the minimum level of lines, lines without a level are left out
+	Level string `json:"level,omitempty"`
+}
+
+func (f *FilterMessage) IsEmpty() bool {
+	return f == nil || (len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.Contains) == 0 && len(f.Fields) == 0 && f.Level == "")
 }
 
 type SubscriberConnectedMessage struct {
 	Connected bool `json:"connected"`
 }
 
+// SessionMessage is sent to a broadcaster once its session is ready
+// token and secret are only set when the session is created, they're never sent again
+type SessionMessage struct {
+	Token  string `json:"token"`
+	Secret string `json:"secret"`
+	// LastSeq is the last line sequence the server has of this session
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+// AckMessage confirms that all lines up to Seq were received, it is sent by the server
+// to broadcasters and optionally by subscribers to the server
+type AckMessage struct {
+	Seq uint64 `json:"seq"`
+}
+
+// ErrorMessage is sent to a peer right before it is disconnected because of Code
+type ErrorMessage struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// TermFrameMessage is raw output of a command running in a pseudo-terminal, frames
+// keep cursor movement and colors so they must be written as is to a terminal
+type TermFrameMessage struct {
+	Data []byte `json:"data"`
+	// Seq is shared with lines, frames and lines of a session are numbered together
+	Seq uint64 `json:"seq,omitempty"`
+	// Offset is when the frame was written in milliseconds since the command started
+	Offset int64 `json:"offset"`
+	// Cols and Rows are only set when the terminal was resized, or on the first frame
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	// Time is set by the server when the frame was received
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// LinesSkippedMessage is sent to a subscriber that couldn't keep up, in place of the lines
+// the server didn't send it
+type LinesSkippedMessage struct {
+	Count uint64 `json:"count"`
+	// Seq is the last skipped line, lines up to it shouldn't be reported as missing again
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// ServerShutdownMessage is sent to every peer right before the server closes their connection
+// with close code 1012 (service restart) because it is shutting down
+type ServerShutdownMessage struct {
+	// ReconnectIn is how long peers should wait before reconnecting in milliseconds
+	ReconnectIn int64 `json:"reconnectIn"`
+}
+
+// ProcessExitMessage is published by `squirrel run` once the wrapped command is done
+type ProcessExitMessage struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+	// Signal is set when the command was killed by a signal
+	Signal string `json:"signal,omitempty"`
+	// Error is set when the command couldn't be started at all
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Duration of the command in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+func (m ProcessExitMessage) Succeeded() bool {
+	return m.ExitCode == 0 && m.Signal == "" && m.Error == ""
+}
+
 func (m Message) MarshalPayload() ([]byte, error) {
+	// Received payloads are kept as they were sent, see NewMessageFromString
+	if raw, ok := m.Payload.(*json.RawMessage); ok {
+		return *raw, nil
+	}
+
 	data, err := json.Marshal(m.Payload)
 
 	if err != nil {
@@ -78,6 +217,24 @@ func (m Message) ToLogMessage() (LogMessage, error) {
 	return logMessage, nil
 }
 
+func (m Message) ToLogLinesMessage() (LogLinesMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return LogLinesMessage{}, err
+	}
+
+	message := LogLinesMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return LogLinesMessage{}, err
+	}
+
+	return message, nil
+}
+
 func (m Message) ToIdentityMessage() (IdentityMessage, error) {
 	data, err := m.MarshalPayload()
 
@@ -152,8 +309,156 @@ func (m Message) ToSubscriberConnectedMessage() (SubscriberConnectedMessage, err
 	return message, nil
 }
 
+func (m Message) ToSessionMessage() (SessionMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return SessionMessage{}, err
+	}
+
+	message := SessionMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return SessionMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToHelloMessage() (HelloMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return HelloMessage{}, err
+	}
+
+	message := HelloMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return HelloMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToAckMessage() (AckMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return AckMessage{}, err
+	}
+
+	message := AckMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return AckMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToErrorMessage() (ErrorMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return ErrorMessage{}, err
+	}
+
+	message := ErrorMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return ErrorMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToProcessExitMessage() (ProcessExitMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return ProcessExitMessage{}, err
+	}
+
+	message := ProcessExitMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return ProcessExitMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToTermFrameMessage() (TermFrameMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return TermFrameMessage{}, err
+	}
+
+	message := TermFrameMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return TermFrameMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToLinesSkippedMessage() (LinesSkippedMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return LinesSkippedMessage{}, err
+	}
+
+	message := LinesSkippedMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return LinesSkippedMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (m Message) ToServerShutdownMessage() (ServerShutdownMessage, error) {
+	data, err := m.MarshalPayload()
+
+	if err != nil {
+		return ServerShutdownMessage{}, err
+	}
+
+	message := ServerShutdownMessage{}
+	err = json.Unmarshal([]byte(data), &message)
+
+	if err != nil {
+		zap.L().Error("Unexpected error while unmarshaling payload", zap.Error(err))
+		return ServerShutdownMessage{}, err
+	}
+
+	return message, nil
+}
+
+// NewMessageFromString decodes the message but not its payload, it is only decoded once
+// into the type of the event by one of the To*Message methods
 func NewMessageFromString(message []byte) (Message, error) {
-	var m Message
+	m := Message{
+		Payload: &json.RawMessage{},
+	}
 
 	err := json.Unmarshal([]byte(message), &m)
 
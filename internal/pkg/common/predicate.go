@@ -0,0 +1,32 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+// FIELD_PREDICATE_PATTERN matches a predicate on a field of JSON lines like `status>=500` or
+// `user.name="John Doe"`, values with spaces are quoted. The web view reads `where=` with it too
+const FIELD_PREDICATE_PATTERN = `([A-Za-z0-9_.@-]+)\s*(!=|>=|<=|=|~|>|<)\s*("[^"]*"|\S*)`
+
+var fieldPredicatePattern = regexp.MustCompile(`^` + FIELD_PREDICATE_PATTERN + `$`)
+
+// ParseFieldPredicate splits a predicate into its field, operator and value, quotes around the value are removed
+func ParseFieldPredicate(expression string) (field, operator, value string, ok bool) {
+	parts := fieldPredicatePattern.FindStringSubmatch(strings.TrimSpace(expression))
+
+	if parts == nil {
+		return "", "", "", false
+	}
+
+	return parts[1], parts[2], unquote(parts[3]), true
+}
+
+// unquote removes the quotes around a predicate value like `"John Doe"`
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
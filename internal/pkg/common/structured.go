@@ -0,0 +1,135 @@
+package common
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Fields structured loggers usually keep the time and the message in
+var (
+	timeFields    = []string{"time", "timestamp", "ts", "@timestamp", "t"}
+	messageFields = []string{"msg", "message", "@message"}
+)
+
+var levelNames = map[int]string{
+	LEVEL_TRACE: "trace",
+	LEVEL_DEBUG: "debug",
+	LEVEL_INFO:  "info",
+	LEVEL_WARN:  "warn",
+	LEVEL_ERROR: "error",
+	LEVEL_FATAL: "fatal",
+}
+
+// StructuredLog is a JSON log line split into the fields every logger has and the rest of its keys
+type StructuredLog struct {
+	// Level is normalized to one of trace, debug, info, warn, error or fatal
+	Level   string `json:"level,omitempty"`
+	Time    string `json:"time,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Fields are the keys of the line that aren't the level, time or message
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LevelName returns the name of a level returned by ParseLevel, FieldsLevel or LineLevel
+func LevelName(level int) string {
+	return levelNames[level]
+}
+
+// ParseStructuredLog returns the fields of a line that is a JSON object, nil for anything else
+func ParseStructuredLog(line string) *StructuredLog {
+	trimmed := strings.TrimSpace(line)
+
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil
+	}
+
+	var fields map[string]interface{}
+
+	if json.Unmarshal([]byte(trimmed), &fields) != nil {
+		return nil
+	}
+
+	structured := &StructuredLog{}
+
+	if level, ok := FieldsLevel(fields); ok {
+		structured.Level = LevelName(level)
+	}
+
+	structured.Time = takeField(fields, timeFields)
+	structured.Message = takeField(fields, messageFields)
+
+	// Level is left in the fields when it isn't one squirrel knows
+	if structured.Level != "" {
+		for _, field := range levelFields {
+			delete(fields, field)
+		}
+	}
+
+	if len(fields) > 0 {
+		structured.Fields = fields
+	}
+
+	return structured
+}
+
+// takeField removes the first of the fields the line has and returns its value as text
+func takeField(fields map[string]interface{}, names []string) string {
+	for _, name := range names {
+		value, ok := fields[name]
+
+		if !ok {
+			continue
+		}
+
+		delete(fields, name)
+
+		switch value := value.(type) {
+		case string:
+			return value
+		case float64:
+			// Unix timestamps would be printed with an exponent otherwise
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			data, _ := json.Marshal(value)
+			return string(data)
+		}
+	}
+
+	return ""
+}
+
+// Size is roughly how many bytes the structured log takes along with its line
+func (s *StructuredLog) Size() int {
+	if s == nil {
+		return 0
+	}
+
+	return len(s.Level) + len(s.Time) + len(s.Message) + valueSize(s.Fields)
+}
+
+func valueSize(value interface{}) int {
+	switch value := value.(type) {
+	case string:
+		return len(value)
+	case map[string]interface{}:
+		size := 0
+
+		for key, field := range value {
+			size += len(key) + valueSize(field)
+		}
+
+		return size
+	case []interface{}:
+		size := 0
+
+		for _, item := range value {
+			size += valueSize(item)
+		}
+
+		return size
+	default:
+		// Numbers, booleans and nulls
+		return 8
+	}
+}
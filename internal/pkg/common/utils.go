@@ -1,12 +1,19 @@
 package common
 
 import (
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,9 +21,16 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+const (
+	// Number of random bytes of generated tokens
+	TOKEN_SIZE = 32
+)
+
 type Domain struct {
 	Public    string
 	Websocket string
+	// Path is the base path every route is under, it is empty when the server is at the root
+	Path string
 }
 
 type LoggerOptions struct {
@@ -80,6 +94,32 @@ func GenerateUUID() string {
 	return id.String()
 }
 
+// GenerateToken returns a random secret that is hard to guess unlike IDs which are shared around
+func GenerateToken() string {
+	data := make([]byte, TOKEN_SIZE)
+
+	if _, err := rand.Read(data); err != nil {
+		log.Fatalf("Error creating random token: %+v", err)
+		os.Exit(1)
+	}
+
+	return hex.EncodeToString(data)
+}
+
+// HashToken is used to avoid keeping secrets as is in memory or on disk
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TokenMatches(token string, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
 func FatalError(message string, err error) {
 	zap.L().Error(message, zap.Error(err))
 	os.Exit(1)
@@ -107,6 +147,38 @@ func StrToInt(value string) int {
 	return intVal
 }
 
+func StrToBool(value string) bool {
+	boolVal, err := strconv.ParseBool(value)
+
+	if err != nil {
+		fmt.Println("Error converting value to bool", err)
+		os.Exit(1)
+	}
+
+	return boolVal
+}
+
+// IsValidCompressionLevel checks the level is one of compress/flate, from HuffmanOnly to BestCompression
+func IsValidCompressionLevel(level int) bool {
+	return level >= flate.HuffmanOnly && level <= flate.BestCompression
+}
+
+func StrToDuration(value string) time.Duration {
+	// Plain numbers are not valid durations except for zero, so allow it to disable things
+	if value == "0" {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		fmt.Println("Error converting value to duration", err)
+		os.Exit(1)
+	}
+
+	return duration
+}
+
 func GetLogLevelFromString(loglevel string) zapcore.Level {
 	level, err := zapcore.ParseLevel(loglevel)
 
@@ -131,29 +203,105 @@ func WinningDefault(value string, values ...string) string {
 	return value
 }
 
-func BuildDomain(domain string, env string) *Domain {
+// BuildDomain builds the URLs of the server under path of the domain (empty at the root), secure is set when the server is reached over TLS
+func BuildDomain(domain string, path string, secure bool) *Domain {
+	return newDomain(domain, strings.TrimSuffix(path, "/"), secure)
+}
+
+// ParseServerURL builds the URLs of the server from its full URL e.g. https://logs.corp:8443/squirrel
+// the scheme tells whether TLS is used and the path is the base path of every route
+func ParseServerURL(server string) (*Domain, error) {
+	u, err := url.Parse(server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var secure bool
+
+	switch u.Scheme {
+	case "http", "ws":
+	case "https", "wss":
+		secure = true
+	default:
+		return nil, fmt.Errorf("scheme of [%s] must be http or https", server)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("[%s] has no host", server)
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("[%s] can't have a query or a fragment", server)
+	}
+
+	return newDomain(u.Host, strings.TrimSuffix(u.Path, "/"), secure), nil
+}
+
+func newDomain(host string, path string, secure bool) *Domain {
 	var s string
 
-	if env == "prod" {
+	if secure {
 		s = "s"
 	}
 
 	public := url.URL{
 		Scheme: fmt.Sprintf("http%s", s),
-		Host:   domain,
+		Host:   host,
+		Path:   path,
 	}
 
 	websocket := url.URL{
 		Scheme: fmt.Sprintf("ws%s", s),
-		Host:   domain,
+		Host:   host,
+		Path:   path,
 	}
 
 	return &Domain{
 		Public:    public.String(),
 		Websocket: websocket.String(),
+		Path:      path,
 	}
 }
 
+// AppendCertsFromFile adds the PEM encoded certificates of the file to the pool
+func AppendCertsFromFile(pool *x509.CertPool, file string) error {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM encoded certificate was found in [%s]", file)
+	}
+
+	return nil
+}
+
+func Contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SplitList splits a comma separated option into its non empty values
+func SplitList(value string) []string {
+	var values []string
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
 func IsJSON(s string) bool {
 	var js map[string]interface{}
 	return json.Unmarshal([]byte(s), &js) == nil
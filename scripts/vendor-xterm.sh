@@ -0,0 +1,20 @@
+#!/bin/sh
+# Vendors xterm into the web view so squirreld serves it instead of the page loading it from a CDN,
+# npm checks the package against the integrity hash published by the registry
+set -eu
+
+XTERM_VERSION=5.3.0
+DEST=${1:-server/view/vendor/xterm}
+WORK=$(mktemp -d)
+
+trap 'rm -rf "$WORK"' EXIT
+
+(cd "$WORK" && npm pack --silent "xterm@$XTERM_VERSION" >/dev/null)
+tar -xzf "$WORK/xterm-$XTERM_VERSION.tgz" -C "$WORK"
+
+mkdir -p "$DEST"
+cp "$WORK/package/lib/xterm.js" "$DEST/xterm.js"
+cp "$WORK/package/css/xterm.css" "$DEST/xterm.css"
+cp "$WORK/package/LICENSE" "$DEST/LICENSE"
+
+echo "Vendored xterm $XTERM_VERSION into $DEST"
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+func (client *Client) info() common.PeerInfo {
+	return common.PeerInfo{
+		Id:            client.id,
+		Address:       client.address,
+		ConnectedAt:   client.connectedAt,
+		Version:       client.Version(),
+		Certificate:   client.certificateName(),
+		BytesReceived: atomic.LoadUint64(&client.received),
+		BytesSent:     atomic.LoadUint64(&client.sent),
+		Dropped:       client.Dropped(),
+	}
+}
+
+func (p *peers) info(id string, subscribers bool) common.SessionInfo {
+	info := common.SessionInfo{
+		Id:              id,
+		SubscriberCount: len(p.subscribers),
+	}
+
+	if p.session != nil {
+		info.CreatedAt = p.session.createdAt
+		info.LastSeq = p.session.seq
+		info.Bytes = p.session.bytes
+		info.Exit = p.session.exit
+	}
+
+	if p.broadcaster != nil {
+		broadcaster := p.broadcaster.info()
+		info.Broadcaster = &broadcaster
+	}
+
+	if !subscribers {
+		return info
+	}
+
+	info.Subscribers = []common.PeerInfo{}
+
+	for subscriber := range p.subscribers {
+		peer := subscriber.info()
+		peer.Acked = atomic.LoadUint64(&subscriber.acked)
+
+		if peer.Acked > 0 && info.LastSeq > peer.Acked {
+			peer.Lag = info.LastSeq - peer.Acked
+		}
+
+		info.Subscribers = append(info.Subscribers, peer)
+	}
+
+	sort.Slice(info.Subscribers, func(i, j int) bool {
+		return info.Subscribers[i].ConnectedAt.Before(info.Subscribers[j].ConnectedAt)
+	})
+
+	return info
+}
+
+func (client *Client) certificateName() string {
+	if client.certificate == nil {
+		return ""
+	}
+
+	return client.certificate.Subject.CommonName
+}
+
+// Sessions lists live sessions, oldest first
+func (h *Hub) Sessions() []common.SessionInfo {
+	sessions := []common.SessionInfo{}
+
+	for _, s := range h.shards {
+		s.mu.Lock()
+
+		for id, p := range s.sessions {
+			// Subscribers of a session that only exists on the storage have nothing live to show
+			if p.session == nil {
+				continue
+			}
+
+			sessions = append(sessions, p.info(id, false))
+		}
+
+		s.mu.Unlock()
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	return sessions
+}
+
+// Session returns a live session along with its subscribers
+func (h *Hub) Session(id string) (common.SessionInfo, bool) {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[id]
+
+	if !ok || p.session == nil {
+		return common.SessionInfo{}, false
+	}
+
+	return p.info(id, true), true
+}
+
+// Terminate disconnects the broadcaster and subscribers of the session and ends it right away
+// stored lines are kept, they are removed by the retention like any other session
+func (h *Hub) Terminate(id string) bool {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[id]
+
+	if !ok {
+		return false
+	}
+
+	zap.S().Warnw("Terminating session", "id", id, "subscribers", len(p.subscribers))
+
+	peerError := NewPeerError(common.ERROR_TERMINATED, "Session [%s] was terminated by an administrator", id)
+
+	if p.broadcaster != nil {
+		p.broadcaster.sendError(peerError)
+		p.broadcaster.closeSend()
+		p.broadcaster = nil
+	}
+
+	for subscriber := range p.subscribers {
+		subscriber.sendError(peerError)
+	}
+
+	h.endSession(s, id, p)
+
+	return true
+}
+
+// Evict disconnects a single subscriber of the session
+func (h *Hub) Evict(id string, subscriberId string) bool {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[id]
+
+	if !ok {
+		return false
+	}
+
+	for subscriber := range p.subscribers {
+		if subscriber.id != subscriberId {
+			continue
+		}
+
+		zap.S().Warnw("Evicting subscriber", "id", subscriberId, "peerId", id)
+
+		subscriber.sendError(NewPeerError(common.ERROR_TERMINATED, "Subscriber was evicted from session [%s] by an administrator", id))
+		subscriber.closeSend()
+		delete(p.subscribers, subscriber)
+		s.cleanup(id)
+
+		return true
+	}
+
+	return false
+}
+
+// AdminAuth only lets requests with the admin token through
+func AdminAuth(context *gin.Context) {
+	if !common.TokenMatches(bearerToken(context), common.HashToken(options.AdminToken)) {
+		context.AbortWithStatus(401)
+		return
+	}
+
+	context.Next()
+}
+
+func AdminListSessions(context *gin.Context) {
+	context.JSON(200, hub.Sessions())
+}
+
+func AdminInspectSession(context *gin.Context) {
+	session, ok := hub.Session(context.Param("clientId"))
+
+	if !ok {
+		context.String(404, "Session not found")
+		return
+	}
+
+	context.JSON(200, session)
+}
+
+func AdminTerminateSession(context *gin.Context) {
+	if !hub.Terminate(context.Param("clientId")) {
+		context.String(404, "Session not found")
+		return
+	}
+
+	context.Status(204)
+}
+
+func AdminEvictSubscriber(context *gin.Context) {
+	if !hub.Evict(context.Param("clientId"), context.Param("subscriberId")) {
+		context.String(404, "Subscriber not found")
+		return
+	}
+
+	context.Status(204)
+}
+
+// bearerToken reads the token of the Authorization header
+func bearerToken(context *gin.Context) string {
+	header := context.GetHeader("Authorization")
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(header, "Bearer ")
+}
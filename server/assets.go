@@ -0,0 +1,34 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:generate sh ../scripts/vendor-xterm.sh view/vendor/xterm
+
+// vendorAssets are third party assets of the web view, xterm is only there once it was vendored
+//
+//go:embed view/vendor
+var vendorAssets embed.FS
+
+func assetsFS() http.FileSystem {
+	assets, err := fs.Sub(vendorAssets, "view/vendor")
+
+	if err != nil {
+		panic(err)
+	}
+
+	return http.FS(assets)
+}
+
+// xtermAssets is where the web view loads xterm from, it is empty if xterm wasn't vendored
+// in which case terminal frames are shown as text, the page never loads scripts of other sites
+func xtermAssets() string {
+	if _, err := fs.Stat(vendorAssets, "view/vendor/xterm/xterm.js"); err != nil {
+		return ""
+	}
+
+	return options.Domain.Path + "/assets/xterm"
+}
@@ -1,7 +1,13 @@
 package server
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -10,16 +16,22 @@ import (
 )
 
 const (
-	WRITE_WAIT           = 10 * time.Second
-	PONG_WAIT            = 60 * time.Second
-	PING_PERIOD          = (PONG_WAIT * 9) / 10
-	EVENT_IDENTITY       = "identity"
-	EVENT_LOG_LINE       = "log_line"
-	EVENT_SUBSCRIBER_ACK = "subscriber_ack"
+	WRITE_WAIT  = 10 * time.Second
+	PONG_WAIT   = 60 * time.Second
+	PING_PERIOD = (PONG_WAIT * 9) / 10
+	// Broadcaster is acknowledged once every ACK_INTERVAL lines so it can release lines it keeps for resending
+	ACK_INTERVAL = 100
+	// Queued messages are written in the same frame until it is this big
+	MAX_FRAME_SIZE = 64 * 1024
 )
 
 type Client struct {
-	id          string
+	id string
+	// address and connectedAt are where and when the peer connected from, for the admin API
+	address     string
+	connectedAt time.Time
+	// certificate is the client certificate the peer presented, nil unless it was verified against the client CA
+	certificate *x509.Certificate
 	broadcaster bool
 	subscriber  bool
 	connection  *websocket.Conn
@@ -27,6 +39,30 @@ type Client struct {
 	send        chan []byte
 	peerId      string
 	active      bool
+	// Last sequence the subscriber already has, used to resume after reconnecting
+	since uint64
+	// Last sequence the subscriber acknowledged, only set if it sends acks, it must be accessed atomically
+	acked uint64
+	// Only lines matching the filter are sent to the subscriber, nil means every line is sent
+	filter *Filter
+	// mu guards the send queue and everything below, the queue is closed once and never written after
+	mu     sync.Mutex
+	closed bool
+	// Protocol version and capabilities negotiated in hello, peers that never said hello speak version 1
+	version      int
+	capabilities []string
+	// policy is the slow subscriber policy the subscriber asked for, empty for the server default
+	policy string
+	// closeMessage is written once the queue is drained, an empty close frame is written when it is nil
+	closeMessage []byte
+	// Messages dropped because the client couldn't keep up
+	dropped uint64
+	// Lines skipped since the subscriber was last told about it, see POLICY_DROP_NEWEST
+	skipped    uint64
+	skippedSeq uint64
+	// Bytes read from and written to the peer, they must be accessed atomically
+	received uint64
+	sent     uint64
 }
 
 func (client *Client) IsActiveBroadcaster() bool {
@@ -37,14 +73,34 @@ func (client *Client) IsActiveSubscriber() bool {
 	return client.subscriber && client.active && client.peerId != ""
 }
 
+func (client *Client) CanRenderFrames() bool {
+	return common.HasCapability(client.capabilities, common.CAPABILITY_TERMINAL)
+}
+
+// setProtocol keeps what was negotiated in hello, the write pump reads it to know how to frame messages
+func (client *Client) setProtocol(version int, capabilities []string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.version = version
+	client.capabilities = capabilities
+}
+
+// coalesces tells whether queued messages can share a frame, peers of the first version
+// read a single message per frame
+func (client *Client) coalesces() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.version >= 2 || common.HasCapability(client.capabilities, common.CAPABILITY_BATCH)
+}
+
 func (client *Client) ReadIncomingMessage() (common.Message, error) {
 	zap.S().Debugw(
 		"Handling client incoming messages",
 		"id", client.id,
 	)
 
-	var message common.Message
-
 	zap.S().Debugw(
 		"Reading message of client",
 		"client", client.id,
@@ -52,19 +108,338 @@ func (client *Client) ReadIncomingMessage() (common.Message, error) {
 		"subscriber", client.subscriber,
 	)
 
-	err := client.connection.ReadJSON(&message)
+	_, data, err := client.connection.ReadMessage()
 
 	if err != nil {
 		if websocket.IsCloseError(err, websocket.CloseAbnormalClosure, websocket.CloseGoingAway) {
 			zap.L().Warn("Unexpected websocket close, peer is disconnected, ignoring message...")
 		}
 
+		if failed(err) {
+			stats.addReadError()
+		}
+
+		return common.Message{}, err
+	}
+
+	stats.addReceived(len(data))
+	atomic.AddUint64(&client.received, uint64(len(data)))
+
+	message, err := common.NewMessageFromString(data)
+
+	if err != nil {
 		return common.Message{}, err
 	}
 
 	return HandleMessage(client, message)
 }
 
+// sendError queues the error event, it is written before the connection is closed
+// since WritePump drains the send channel before closing it
+func (client *Client) sendError(peerError *PeerError) {
+	data, err := peerError.ToMessage().Marshal()
+
+	if err != nil {
+		return
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		zap.S().Warnw("Client send queue is full, dropping error event", "id", client.id, "code", peerError.Code)
+	}
+}
+
+// closeSend closes the send queue so WritePump writes what is left and closes the connection
+func (client *Client) closeSend() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return
+	}
+
+	client.closed = true
+	close(client.send)
+}
+
+// shutdown queues the shutdown event and closes the send queue, WritePump closes the connection
+// with code 1012 once everything queued before was written
+func (client *Client) shutdown(message []byte) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return
+	}
+
+	if message != nil {
+		select {
+		case client.send <- message:
+		default:
+			zap.S().Warnw("Client send queue is full, dropping shutdown event", "id", client.id)
+		}
+	}
+
+	client.closeMessage = shutdownCloseMessage()
+	client.closed = true
+	close(client.send)
+}
+
+// writeClose writes the close frame once the send queue was closed
+func (client *Client) writeClose() {
+	client.mu.Lock()
+	message := client.closeMessage
+	client.mu.Unlock()
+
+	if message == nil {
+		message = []byte{}
+	}
+
+	client.connection.WriteMessage(websocket.CloseMessage, message)
+}
+
+// setPolicy makes the subscriber use its own slow subscriber policy instead of the server default
+func (client *Client) setPolicy(policy string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.policy = policy
+}
+
+// slowPolicy is the slow subscriber policy of the client, client.mu must be held
+func (client *Client) slowPolicy() string {
+	return common.WinningDefault(client.policy, options.SlowSubscriberPolicy)
+}
+
+// Version is the protocol version the client negotiated in hello
+func (client *Client) Version() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.version
+}
+
+// Dropped is how many messages were never sent to the client
+func (client *Client) Dropped() uint64 {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.dropped
+}
+
+// enqueue hands the message to WritePump without ever blocking, what happens when the queue
+// of a subscriber is full depends on the slow subscriber policy, it returns false when
+// the subscriber has to be disconnected
+// seq is the sequence of the line or frame being sent and 0 for any other message, those are
+// control messages like process_exit that the policy doesn't apply to, see enqueueControl
+func (client *Client) enqueue(message []byte, seq uint64) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return true
+	}
+
+	if seq == 0 {
+		client.enqueueControl(message)
+		return true
+	}
+
+	if client.skipped > 0 && !client.sendSkipped() {
+		client.skip(seq)
+		return true
+	}
+
+	select {
+	case client.send <- message:
+		return true
+	default:
+	}
+
+	// Broadcasters only get acks and confirmations, there is nothing to tell them about
+	if !client.subscriber {
+		client.drop()
+		return true
+	}
+
+	switch client.slowPolicy() {
+	case POLICY_DROP_OLDEST:
+		select {
+		case <-client.send:
+			client.drop()
+		default:
+		}
+
+		select {
+		case client.send <- message:
+		default:
+			client.drop()
+		}
+	case POLICY_DISCONNECT:
+		client.drop()
+		return false
+	default:
+		client.skip(seq)
+	}
+
+	return true
+}
+
+// enqueueControl always queues the message, queued lines are evicted to make room for it when
+// the queue is full. Subscribers are told about skipped lines before the message
+func (client *Client) enqueueControl(message []byte) {
+	for cap(client.send)-len(client.send) < client.controlRoom() {
+		if !client.evict() {
+			break
+		}
+	}
+
+	if client.skipped > 0 {
+		client.sendSkipped()
+	}
+
+	select {
+	case client.send <- message:
+	default:
+		client.drop()
+	}
+}
+
+// controlRoom is how many messages enqueueControl queues, the message and the skipped lines if any
+func (client *Client) controlRoom() int {
+	if client.skipped > 0 {
+		return 2
+	}
+
+	return 1
+}
+
+// evict drops the oldest queued line, the messages around it are queued again in the same order.
+// The oldest message is dropped when only control messages are queued, it returns false when
+// the queue is empty
+func (client *Client) evict() bool {
+	queued := make([][]byte, 0, len(client.send))
+	evicted := false
+
+	for done := false; !done; {
+		select {
+		case data := <-client.send:
+			if seq, ok := lineSeq(data); ok && !evicted {
+				evicted = true
+				client.evicted(seq)
+				continue
+			}
+
+			queued = append(queued, data)
+		default:
+			done = true
+		}
+	}
+
+	if !evicted && len(queued) > 0 {
+		queued = queued[1:]
+		evicted = true
+		client.drop()
+	}
+
+	// Nothing else writes to the queue while mu is held, there is room for all of them
+	for _, data := range queued {
+		client.send <- data
+	}
+
+	return evicted
+}
+
+// evicted accounts for a line evicted from the queue, subscribers dropping new lines are told
+// about it like any line they skipped
+func (client *Client) evicted(seq uint64) {
+	if client.subscriber && client.slowPolicy() == POLICY_DROP_NEWEST {
+		client.skip(seq)
+		return
+	}
+
+	client.drop()
+}
+
+// lineSeq returns the sequence of a queued line or terminal frame, it is only read when lines
+// are evicted from the queue
+func lineSeq(data []byte) (uint64, bool) {
+	var message struct {
+		Event   string `json:"event"`
+		Payload struct {
+			Seq uint64 `json:"seq"`
+		} `json:"payload"`
+	}
+
+	if json.Unmarshal(data, &message) != nil {
+		return 0, false
+	}
+
+	if message.Event != common.EVENT_LOG_LINE && message.Event != common.EVENT_TERM_FRAME {
+		return 0, false
+	}
+
+	return message.Payload.Seq, true
+}
+
+func (client *Client) drop() {
+	if client.dropped == 0 {
+		zap.S().Warnw("Client can't keep up, dropping messages",
+			"id", client.id,
+			"peerId", client.peerId,
+			"policy", client.slowPolicy())
+	}
+
+	client.dropped++
+	stats.addDropped()
+}
+
+func (client *Client) skip(seq uint64) {
+	client.drop()
+	client.skipped++
+
+	if seq > client.skippedSeq {
+		client.skippedSeq = seq
+	}
+}
+
+// sendSkipped tells the subscriber how many lines it missed, once its queue has room again
+func (client *Client) sendSkipped() bool {
+	message := common.Message{
+		Id:    client.peerId,
+		Event: common.EVENT_LINES_SKIPPED,
+		Payload: common.LinesSkippedMessage{
+			Count: client.skipped,
+			Seq:   client.skippedSeq,
+		},
+	}
+
+	data, err := message.Marshal()
+
+	if err != nil {
+		client.skipped = 0
+		client.skippedSeq = 0
+		return true
+	}
+
+	select {
+	case client.send <- data:
+		client.skipped = 0
+		client.skippedSeq = 0
+		return true
+	default:
+		return false
+	}
+}
+
 func (client *Client) writeMessage(message []byte) (io.WriteCloser, error) {
 	zap.S().Debug("Setting connection write deadline")
 	err := client.connection.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
@@ -81,8 +456,6 @@ func (client *Client) writeMessage(message []byte) (io.WriteCloser, error) {
 		return nil, err
 	}
 
-	zap.S().Debugw("Writing message", "message", string(message))
-
 	_, err = writer.Write(message)
 
 	if err != nil {
@@ -94,11 +467,11 @@ func (client *Client) writeMessage(message []byte) (io.WriteCloser, error) {
 }
 
 func (client *Client) ReadPump() {
+	// Connection is closed by WritePump once the send channel is closed by the hub
+	// that way pending messages like error events still reach the peer
 	defer func() {
 		zap.S().Info("Removing client")
-		client.hub.unregister <- client
-		zap.S().Info("Closing client connection")
-		client.connection.Close()
+		client.hub.Leave(client)
 	}()
 
 	readDeadline := time.Now().Add(PONG_WAIT)
@@ -119,14 +492,22 @@ func (client *Client) ReadPump() {
 	})
 
 	for {
-		_, err := client.ReadIncomingMessage()
+		message, err := client.ReadIncomingMessage()
 
 		if err != nil {
 			zap.L().Error("Error handling message, disconnecting peer", zap.Error(err), zap.String("peerId", client.id))
+
+			var peerError *PeerError
+
+			if errors.As(err, &peerError) {
+				client.sendError(peerError)
+			}
+
 			return
 		}
 
-		if client.IsActiveSubscriber() {
+		// Broadcaster only needs to know when a subscriber joins, not about every message it sends
+		if message.Event == common.EVENT_IDENTITY && client.IsActiveSubscriber() {
 			zap.S().Debugw(
 				"Client is active subscriber",
 				"peerId", client.peerId,
@@ -140,56 +521,85 @@ func (client *Client) ReadPump() {
 			ackMessage := common.Message{
 				Id:      "",
 				Payload: ackPayload,
-				Event:   EVENT_SUBSCRIBER_ACK,
+				Event:   common.EVENT_SUBSCRIBER_ACK,
 			}
 
-			message, err := ackMessage.Marshal()
+			data, err := ackMessage.Marshal()
 
 			if err != nil {
 				return
 			}
 
-			client.hub.send <- struct {
-				message  []byte
-				clientId string
-			}{
-				message:  message,
-				clientId: client.peerId,
-			}
+			client.hub.Send(client.peerId, data)
 		}
 	}
 }
 
-func writeQueuedMessages(client *Client, writer io.WriteCloser) error {
-	zap.S().Info("Sending queued messages")
+// writeFrame writes the message along with messages that are already queued in a single frame
+// separated by new lines, it stops once the frame reaches MAX_FRAME_SIZE so a busy session
+// doesn't hold a single frame forever, closed is true when the send queue was closed.
+// Peers that don't read coalesced frames get the message on its own
+func (client *Client) writeFrame(message []byte) (closed bool, err error) {
+	start := time.Now()
+	coalesce := client.coalesces()
 
-	// Handle queued messages
-	for i := 0; i < len(client.send); i++ {
-		_, err := writer.Write([]byte{'\n'})
+	writer, err := client.writeMessage(message)
 
-		if err != nil {
-			zap.L().Error("Error writing newline", zap.Error(err))
-			return err
-		}
+	if err != nil {
+		return false, err
+	}
 
-		message, ok := <-client.send
+	messages, size := 1, len(message)
 
-		if !ok {
-			zap.S().Info("Sending queued message was not OK, closing connection..")
-			client.connection.WriteMessage(websocket.CloseMessage, []byte{})
-			return err
-		}
+queued:
+	for coalesce && size < MAX_FRAME_SIZE {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				closed = true
+				break queued
+			}
 
-		zap.S().Debugw("Writing message", "message", string(message))
-		_, err = writer.Write(message)
+			_, err := writer.Write([]byte{'\n'})
 
-		if err != nil {
-			zap.L().Error("Error writing message", zap.Error(err))
-			return err
+			if err != nil {
+				zap.L().Error("Error writing newline", zap.Error(err))
+				return false, err
+			}
+
+			_, err = writer.Write(message)
+
+			if err != nil {
+				zap.L().Error("Error writing message", zap.Error(err))
+				return false, err
+			}
+
+			messages++
+			size += len(message) + 1
+		default:
+			break queued
 		}
 	}
 
-	return nil
+	if err := writer.Close(); err != nil {
+		zap.L().Error("Error closing writer", zap.Error(err))
+		return false, err
+	}
+
+	stats.addSent(messages, size)
+	atomic.AddUint64(&client.sent, uint64(size))
+	frameSize.Observe(float64(size))
+	writeDuration.Observe(time.Since(start).Seconds())
+
+	return closed, nil
+}
+
+// failed tells connections that broke apart from ones the server closed or the peer closed on purpose
+// squirrel exits without a close frame, so abnormal closures are how most peers leave
+func failed(err error) bool {
+	return !errors.Is(err, net.ErrClosed) &&
+		!errors.Is(err, websocket.ErrCloseSent) &&
+		!websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure)
 }
 
 func sendPingMessage(client *Client) error {
@@ -218,6 +628,8 @@ func (client *Client) WritePump() {
 		ticker.Stop()
 		zap.S().Info("Closing connection")
 		client.connection.Close()
+		stats.removeConnection()
+		connections.remove(client)
 	}()
 
 	for {
@@ -225,30 +637,33 @@ func (client *Client) WritePump() {
 		case message, ok := <-client.send:
 			if !ok {
 				zap.S().Info("Sending message was not OK, closing connection..")
-				client.connection.WriteMessage(websocket.CloseMessage, []byte{})
+				client.writeClose()
 				return
 			}
 
-			writer, err := client.writeMessage(message)
+			closed, err := client.writeFrame(message)
 
 			if err != nil {
-				return
-			}
-
-			err = writeQueuedMessages(client, writer)
+				if failed(err) {
+					stats.addWriteError()
+				}
 
-			if err != nil {
 				return
 			}
 
-			if err := writer.Close(); err != nil {
-				zap.L().Error("Error closing writer", zap.Error(err))
+			if closed {
+				zap.S().Info("Send queue was closed, closing connection..")
+				client.writeClose()
 				return
 			}
 		case <-ticker.C:
 			err := sendPingMessage(client)
 
 			if err != nil {
+				if failed(err) {
+					stats.addWriteError()
+				}
+
 				return
 			}
 		}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+const (
+	// Lines that are queued for a subscriber at once, like a batch sent by a broadcaster
+	BENCH_QUEUED = 200
+	BENCH_LINE   = `{"event":"log_line","id":"4f1d","payload":{"line":"2022-03-14T10:12:43.512Z	INFO	server/hub.go:118	Adding subscriber to session","seq":1,"stream":"stdout"}}`
+)
+
+// newBenchClient returns a client connected to a subscriber that reads and drops every message
+func newBenchClient(b *testing.B) *Client {
+	upgrader := websocket.Upgrader{}
+	connections := make(chan *websocket.Conn, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			b.Errorf("upgrading: %v", err)
+			return
+		}
+
+		connections <- connection
+	}))
+
+	b.Cleanup(server.Close)
+
+	subscriber, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		b.Fatalf("dialing: %v", err)
+	}
+
+	b.Cleanup(func() { subscriber.Close() })
+
+	go func() {
+		for {
+			if _, _, err := subscriber.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	connection := <-connections
+	b.Cleanup(func() { connection.Close() })
+
+	return &Client{
+		connection: connection,
+		send:       make(chan []byte, BENCH_QUEUED),
+		version:    common.PROTOCOL_VERSION,
+	}
+}
+
+// benchmarkWrites queues lines BENCH_QUEUED at a time and lets write send the queue
+func benchmarkWrites(b *testing.B, write func(client *Client, message []byte) error) {
+	client := newBenchClient(b)
+	message := []byte(BENCH_LINE)
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += BENCH_QUEUED {
+		for j := i; j < i+BENCH_QUEUED && j < b.N; j++ {
+			client.send <- message
+		}
+
+		for len(client.send) > 0 {
+			if err := write(client, <-client.send); err != nil {
+				b.Fatalf("writing: %v", err)
+			}
+		}
+	}
+}
+
+// BenchmarkWriteUnbatched writes every queued line in its own frame
+func BenchmarkWriteUnbatched(b *testing.B) {
+	benchmarkWrites(b, func(client *Client, message []byte) error {
+		writer, err := client.writeMessage(message)
+
+		if err != nil {
+			return err
+		}
+
+		return writer.Close()
+	})
+}
+
+// BenchmarkWriteFrame coalesces queued lines with writeFrame
+func BenchmarkWriteFrame(b *testing.B) {
+	benchmarkWrites(b, func(client *Client, message []byte) error {
+		_, err := client.writeFrame(message)
+		return err
+	})
+}
+
+func TestEnqueueControlMessage(t *testing.T) {
+	setTestOptions(0)
+
+	client := &Client{
+		subscriber: true,
+		send:       make(chan []byte, 3),
+	}
+
+	lines := make([][]byte, 3)
+
+	for i := range lines {
+		record := Record{Seq: uint64(i + 1), Line: "line"}
+		lines[i], _ = record.Marshal("session")
+		client.enqueue(lines[i], record.Seq)
+	}
+
+	// Queue is full, the newest line is skipped under drop_newest
+	extra, _ := Record{Seq: 4, Line: "line"}.Marshal("session")
+	client.enqueue(extra, 4)
+
+	exit := []byte(`{"id":"session","payload":{"exitCode":0},"event":"process_exit"}`)
+
+	if !client.enqueue(exit, 0) {
+		t.Fatalf("control message asked for the subscriber to be disconnected")
+	}
+
+	var events []string
+
+	for len(client.send) > 0 {
+		var message common.Message
+
+		if err := json.Unmarshal(<-client.send, &message); err != nil {
+			t.Fatalf("decoding queued message: %v", err)
+		}
+
+		events = append(events, message.Event)
+
+		if message.Event == common.EVENT_LINES_SKIPPED {
+			skipped := message.Payload.(map[string]interface{})
+
+			if skipped["count"] != 3.0 || skipped["seq"] != 4.0 {
+				t.Errorf("lines skipped up to %v is %v, expected 3 up to 4", skipped["seq"], skipped["count"])
+			}
+		}
+	}
+
+	expected := []string{common.EVENT_LOG_LINE, common.EVENT_LINES_SKIPPED, common.EVENT_PROCESS_EXIT}
+
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("queue has %v, expected %v", events, expected)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+// PeerError is reported back to the peer as an error event before it gets disconnected
+type PeerError struct {
+	Code    string
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func NewPeerError(code string, format string, a ...interface{}) *PeerError {
+	return &PeerError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *PeerError) ToMessage() common.Message {
+	return common.Message{
+		Event: common.EVENT_ERROR,
+		Payload: common.ErrorMessage{
+			Code:    e.Code,
+			Message: e.Message,
+		},
+	}
+}
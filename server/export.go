@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+const (
+	EXPORT_FORMAT_RAW    = "raw"
+	EXPORT_FORMAT_NDJSON = "ndjson"
+	ANSI_STRIP           = "strip"
+)
+
+var exportContentTypes = map[string]string{
+	EXPORT_FORMAT_RAW:    "text/plain; charset=utf-8",
+	EXPORT_FORMAT_NDJSON: "application/x-ndjson",
+}
+
+func RawExport(context *gin.Context) {
+	exportSession(context, EXPORT_FORMAT_RAW)
+}
+
+func NDJSONExport(context *gin.Context) {
+	exportSession(context, EXPORT_FORMAT_NDJSON)
+}
+
+func writeRecord(writer *bufio.Writer, record Record, format string, stripColors bool) error {
+	if stripColors {
+		record.Line = common.StripANSI(record.Line)
+	}
+
+	if format == EXPORT_FORMAT_NDJSON {
+		data, err := json.Marshal(record)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	} else if record.IsFrame() {
+		// Frames are written as is, the export can then be replayed with cat in a terminal
+		_, err := writer.Write(record.Data)
+
+		return err
+	} else {
+		if _, err := writer.WriteString(record.Line); err != nil {
+			return err
+		}
+	}
+
+	return writer.WriteByte('\n')
+}
+
+// exportSession streams the whole stored session when storage is enabled
+// otherwise only what is still kept in the scrollback can be exported
+func exportSession(context *gin.Context, format string) {
+	clientId := context.Param("clientId")
+
+	zap.S().Debugw("Incoming export request", "clientId", clientId, "format", format)
+
+	if !hub.SessionExists(clientId) {
+		zap.S().Debugf("Client ID: [%s] doesn't exist on the hub\n", clientId)
+		context.String(404, "Client not found")
+		return
+	}
+
+	if !hub.Authorize(clientId, requestToken(context)) {
+		zap.S().Debugf("Export request of client ID: [%s] has an invalid token\n", clientId)
+		context.String(401, "Unauthorized")
+		return
+	}
+
+	filter, err := NewFilter(requestFilter(context))
+
+	if err != nil {
+		context.String(400, "Filter is not valid: %s", err)
+		return
+	}
+
+	// Exports can be narrowed down to a few streams e.g. ?stream=stderr&stream=app.log
+	streams := context.QueryArray("stream")
+	// Colors of lines can be removed with ?ansi=strip, terminal frames are always exported as is
+	stripColors := context.Query("ansi") == ANSI_STRIP
+
+	// Status is only written once the request is known to be valid, it can't be changed after
+	context.Status(200)
+	context.Header("Content-Type", exportContentTypes[format])
+
+	writer := bufio.NewWriter(context.Writer)
+	write := func(record Record) error {
+		if len(streams) > 0 && !common.Contains(streams, common.WinningDefault(record.Stream, common.DEFAULT_STREAM)) {
+			return nil
+		}
+
+		if !filter.Match(record, nil) {
+			return nil
+		}
+
+		return writeRecord(writer, record, format, stripColors)
+	}
+
+	if hub.storage != nil && hub.storage.Exists(clientId) {
+		err = hub.storage.ReadRecords(clientId, write)
+	} else {
+		for _, record := range hub.Records(clientId) {
+			if err = write(record); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		zap.L().Error("Error exporting session", zap.String("clientId", clientId), zap.Error(err))
+		return
+	}
+
+	if err := writer.Flush(); err != nil {
+		zap.L().Error("Error flushing session export", zap.String("clientId", clientId), zap.Error(err))
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+const (
+	// Filters are compiled for every subscriber, these limits keep a single subscriber from being too expensive
+	MAX_FILTER_EXPRESSIONS       = 32
+	MAX_FILTER_EXPRESSION_LENGTH = 1024
+)
+
+// fieldPredicate is a condition on a field of JSON lines, nested fields are separated by dots
+type fieldPredicate struct {
+	path     []string
+	operator string
+	value    string
+	number   float64
+	isNumber bool
+	pattern  *regexp.Regexp
+}
+
+// LineFields are the fields and the level of a line, they're parsed once for all the subscribers
+// of a record no matter how many of them filter on them
+type LineFields struct {
+	record      Record
+	fields      map[string]interface{}
+	parsed      bool
+	level       int
+	hasLevel    bool
+	levelParsed bool
+}
+
+func NewLineFields(record Record) *LineFields {
+	return &LineFields{record: record}
+}
+
+// Get parses the line the first time it is called, fields are nil when the line isn't a JSON object
+func (l *LineFields) Get() map[string]interface{} {
+	if l.parsed {
+		return l.fields
+	}
+
+	l.parsed = true
+
+	if l.record.IsFrame() {
+		return nil
+	}
+
+	line := strings.TrimSpace(common.StripANSI(l.record.Line))
+
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &l.fields) != nil {
+		l.fields = nil
+	}
+
+	return l.fields
+}
+
+// Level finds the level of the line the first time it is called, it prefers the level
+// the broadcaster already parsed out of a JSON line
+func (l *LineFields) Level() (int, bool) {
+	if l.levelParsed {
+		return l.level, l.hasLevel
+	}
+
+	l.levelParsed = true
+
+	switch {
+	case l.record.IsFrame():
+	case l.record.Structured != nil && l.record.Structured.Level != "":
+		l.level, l.hasLevel = common.ParseLevel(l.record.Structured.Level)
+	case l.Get() != nil:
+		l.level, l.hasLevel = common.FieldsLevel(l.fields)
+	default:
+		l.level, l.hasLevel = common.TextLevel(common.StripANSI(l.record.Line))
+	}
+
+	return l.level, l.hasLevel
+}
+
+// Filter is the compiled filter of a subscriber, it is evaluated by the hub before
+// lines are queued to the subscriber
+type Filter struct {
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	contains []string
+	fields   []fieldPredicate
+	level    int
+}
+
+// NewFilter compiles the filter a subscriber asked for, it returns nil when there is nothing to filter
+func NewFilter(message *common.FilterMessage) (*Filter, error) {
+	if message.IsEmpty() {
+		return nil, nil
+	}
+
+	count := len(message.Include) + len(message.Exclude) + len(message.Contains) + len(message.Fields)
+
+	if count > MAX_FILTER_EXPRESSIONS {
+		return nil, fmt.Errorf("filter has %d expressions, at most %d are allowed", count, MAX_FILTER_EXPRESSIONS)
+	}
+
+	filter := &Filter{
+		contains: message.Contains,
+	}
+
+	var err error
+
+	if filter.include, err = compilePatterns(message.Include); err != nil {
+		return nil, err
+	}
+
+	if filter.exclude, err = compilePatterns(message.Exclude); err != nil {
+		return nil, err
+	}
+
+	for _, expression := range message.Fields {
+		predicate, err := parseFieldPredicate(expression)
+
+		if err != nil {
+			return nil, err
+		}
+
+		filter.fields = append(filter.fields, predicate)
+	}
+
+	if message.Level != "" {
+		level, ok := common.ParseLevel(message.Level)
+
+		if !ok {
+			return nil, fmt.Errorf("level [%s] is not known", message.Level)
+		}
+
+		filter.level = level
+	}
+
+	return filter, nil
+}
+
+func compilePatterns(expressions []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+
+	for _, expression := range expressions {
+		if len(expression) > MAX_FILTER_EXPRESSION_LENGTH {
+			return nil, fmt.Errorf("expression is longer than %d characters", MAX_FILTER_EXPRESSION_LENGTH)
+		}
+
+		pattern, err := regexp.Compile(expression)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression [%s]: %w", expression, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+func parseFieldPredicate(expression string) (fieldPredicate, error) {
+	if len(expression) > MAX_FILTER_EXPRESSION_LENGTH {
+		return fieldPredicate{}, fmt.Errorf("expression is longer than %d characters", MAX_FILTER_EXPRESSION_LENGTH)
+	}
+
+	field, operator, value, ok := common.ParseFieldPredicate(expression)
+
+	if !ok {
+		return fieldPredicate{}, fmt.Errorf("invalid field predicate [%s], it must look like field=value", expression)
+	}
+
+	predicate := fieldPredicate{
+		path:     strings.Split(field, "."),
+		operator: operator,
+		value:    value,
+	}
+
+	number, err := strconv.ParseFloat(predicate.value, 64)
+	predicate.number, predicate.isNumber = number, err == nil
+
+	switch predicate.operator {
+	case "~":
+		predicate.pattern, err = regexp.Compile(predicate.value)
+
+		if err != nil {
+			return fieldPredicate{}, fmt.Errorf("invalid regular expression [%s]: %w", predicate.value, err)
+		}
+	case ">", ">=", "<", "<=":
+		if !predicate.isNumber {
+			return fieldPredicate{}, fmt.Errorf("field predicate [%s] compares with a value that is not a number", expression)
+		}
+	}
+
+	return predicate, nil
+}
+
+// HasFields tells if the filter has field predicates, fields of JSON lines only have to be parsed then
+func (f *Filter) HasFields() bool {
+	return f != nil && len(f.fields) > 0
+}
+
+// HasLevel tells if the filter has a minimum level, the level of lines only has to be parsed then
+func (f *Filter) HasLevel() bool {
+	return f != nil && f.level > 0
+}
+
+// Match tells if the record has to be sent to the subscriber, terminal frames
+// aren't lines so they're never filtered. Fields are the parsed fields and level of the record
+// shared with other subscribers, they're parsed here when they're nil
+func (f *Filter) Match(record Record, fields *LineFields) bool {
+	if f == nil || record.IsFrame() {
+		return true
+	}
+
+	line := common.StripANSI(record.Line)
+
+	for _, substring := range f.contains {
+		if !strings.Contains(line, substring) {
+			return false
+		}
+	}
+
+	for _, pattern := range f.exclude {
+		if pattern.MatchString(line) {
+			return false
+		}
+	}
+
+	if len(f.include) > 0 && !matchesAny(f.include, line) {
+		return false
+	}
+
+	if fields == nil {
+		fields = NewLineFields(record)
+	}
+
+	if f.level > 0 {
+		level, ok := fields.Level()
+
+		if !ok || level < f.level {
+			return false
+		}
+	}
+
+	if len(f.fields) == 0 {
+		return true
+	}
+
+	values := fields.Get()
+
+	if values == nil {
+		return false
+	}
+
+	for _, predicate := range f.fields {
+		if !predicate.match(values) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchesAny(patterns []*regexp.Regexp, line string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p fieldPredicate) match(fields map[string]interface{}) bool {
+	var value interface{} = fields
+
+	for _, key := range p.path {
+		object, ok := value.(map[string]interface{})
+
+		if !ok {
+			return p.operator == "!="
+		}
+
+		if value, ok = object[key]; !ok {
+			return p.operator == "!="
+		}
+	}
+
+	number, isNumber := value.(float64)
+	text := fmt.Sprint(value)
+
+	switch p.operator {
+	case "=":
+		if isNumber && p.isNumber {
+			return number == p.number
+		}
+
+		return strings.EqualFold(text, p.value)
+	case "!=":
+		if isNumber && p.isNumber {
+			return number != p.number
+		}
+
+		return !strings.EqualFold(text, p.value)
+	case "~":
+		return p.pattern.MatchString(text)
+	case ">":
+		return isNumber && number > p.number
+	case ">=":
+		return isNumber && number >= p.number
+	case "<":
+		return isNumber && number < p.number
+	case "<=":
+		return isNumber && number <= p.number
+	}
+
+	return false
+}
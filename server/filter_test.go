@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+func TestFilterQuotedFieldPredicate(t *testing.T) {
+	filter, err := NewFilter(&common.FilterMessage{Fields: []string{`user.name="John Doe"`}})
+
+	if err != nil {
+		t.Fatalf("compiling filter: %v", err)
+	}
+
+	lines := map[string]bool{
+		`{"user":{"name":"John Doe"}}`:     true,
+		`{"user":{"name":"john doe"}}`:     true,
+		`{"user":{"name":"\"John Doe\""}}`: false,
+		`{"user":{"name":"John"}}`:         false,
+	}
+
+	for line, expected := range lines {
+		if matched := filter.Match(Record{Line: line}, nil); matched != expected {
+			t.Errorf("matching %s gave %v, expected %v", line, matched, expected)
+		}
+	}
+}
+
+func TestLineFieldsLevel(t *testing.T) {
+	lines := map[string]int{
+		`{"level":"warn","msg":"slow query"}`: common.LEVEL_WARN,
+		`{"lvl":50,"msg":"failed"}`:           common.LEVEL_ERROR,
+		"\x1b[31mERROR\x1b[0m request failed": common.LEVEL_ERROR,
+		`{"msg":"no level"}`:                  0,
+	}
+
+	for line, expected := range lines {
+		level, _ := NewLineFields(Record{Line: line}).Level()
+
+		if level != expected {
+			t.Errorf("level of %q is %d, expected %d", line, level, expected)
+		}
+	}
+
+	// Level the broadcaster parsed wins over the line itself
+	fields := NewLineFields(Record{Line: `{"level":"info"}`, Structured: &common.StructuredLog{Level: "fatal"}})
+
+	if level, ok := fields.Level(); !ok || level != common.LEVEL_FATAL {
+		t.Errorf("level is %d, expected the structured level %d", level, common.LEVEL_FATAL)
+	}
+}
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"crypto/x509"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -9,26 +14,58 @@ import (
 	"go.uber.org/zap"
 )
 
+// REDACTED replaces secrets in logged requests
+const REDACTED = "redacted"
+
 func InitHttpServer() {
 	zap.S().Debug("Initializing server routes")
 
-	server.GET("/", func(context *gin.Context) {
+	// Every route lives under the base path so squirreld can be served behind a path prefixed proxy
+	router := server.Group(options.BasePath)
+
+	router.GET("/", func(context *gin.Context) {
 		context.HTML(200, HTML_MAIN_INDEX, nil)
 	})
 
-	server.GET("/ws", func(context *gin.Context) {
-		WebsocketHandler(context.Request, context.Writer)
+	router.GET("/ws", func(context *gin.Context) {
+		WebsocketHandler(context.Request, context.Writer, context.ClientIP())
 	})
 
-	server.GET("/client/:clientId", SubscriberView)
+	router.StaticFS("/assets", assetsFS())
+	router.GET("/client/:clientId", SubscriberView)
+	router.GET("/client/:clientId/raw", RawExport)
+	router.GET("/client/:clientId/ndjson", NDJSONExport)
+
+	if options.Metrics {
+		router.GET("/metrics", MetricsHandler)
+	}
+
+	// Admin API is only available once a token was set for it
+	if options.AdminToken != "" {
+		admin := router.Group("/admin", AdminAuth)
+		admin.GET("/sessions", AdminListSessions)
+		admin.GET("/sessions/:clientId", AdminInspectSession)
+		admin.DELETE("/sessions/:clientId", AdminTerminateSession)
+		admin.DELETE("/sessions/:clientId/subscribers/:subscriberId", AdminEvictSubscriber)
+	}
 }
 
-func WebsocketHandler(r *http.Request, w http.ResponseWriter) {
+// WebsocketHandler upgrades the request of a peer, address is where it connected from
+func WebsocketHandler(r *http.Request, w http.ResponseWriter, address string) {
 	zap.S().Info("Handling websocket upgrade request")
 
+	// Subscribers can pick their slow subscriber policy when connecting e.g. /ws?policy=disconnect
+	policy := r.URL.Query().Get("policy")
+
+	if policy != "" && !isSlowSubscriberPolicy(policy) {
+		http.Error(w, fmt.Sprintf("Invalid slow subscriber policy: [%s]", policy), http.StatusBadRequest)
+		return
+	}
+
 	var wsUpgrader = websocket.Upgrader{
-		ReadBufferSize:  options.ReadBufferSize,
-		WriteBufferSize: options.WriteBufferSize,
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		EnableCompression: options.Compression,
 	}
 
 	connection, err := wsUpgrader.Upgrade(w, r, nil)
@@ -38,24 +75,48 @@ func WebsocketHandler(r *http.Request, w http.ResponseWriter) {
 		return
 	}
 
+	// Level was validated with the options, it only applies if the peer negotiated compression
+	_ = connection.SetCompressionLevel(options.CompressionLevel)
+
 	zap.S().Info("Websocket connection was successful")
 
+	stats.addConnection()
+
 	client := &Client{
 		id:          common.GenerateUUID(),
+		address:     address,
+		connectedAt: time.Now(),
+		certificate: verifiedCertificate(r),
 		connection:  connection,
 		hub:         hub,
 		broadcaster: false,
-		send:        make(chan []byte, 256),
+		policy:      policy,
+		// Scrollback is replayed all at once when a subscriber joins, it must fit on top of the queue
+		send: make(chan []byte, options.SendQueueSize+options.ScrollbackLines),
 	}
 
-	zap.S().Infow("Initialized new client", "clientId", client.id)
+	if !connections.add(client) {
+		zap.S().Infow("Server is shutting down, closing new connection", "clientId", client.id)
+		giveUp(connection)
+		stats.removeConnection()
+		return
+	}
 
-	client.hub.register <- client
+	zap.S().Infow("Initialized new client", "clientId", client.id)
 
 	go client.ReadPump()
 	go client.WritePump()
 }
 
+// verifiedCertificate returns the client certificate of the request if it was signed by the client CA
+func verifiedCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
 func SubscriberView(context *gin.Context) {
 	clientId := context.Param("clientId")
 
@@ -67,7 +128,7 @@ func SubscriberView(context *gin.Context) {
 		return
 	}
 
-	if _, ok := hub.clients[clientId]; !ok {
+	if !hub.SessionExists(clientId) {
 		zap.S().Debugf("Client ID: [%s] doesn't exist on the hub\n", clientId)
 		context.String(404, "Client not found")
 		return
@@ -75,8 +136,101 @@ func SubscriberView(context *gin.Context) {
 
 	zap.S().Debugf("Client ID: [%s] was found on hub\n", clientId)
 
+	token := requestToken(context)
+
+	if !hub.Authorize(clientId, token) {
+		zap.S().Debugf("Request to client ID: [%s] has an invalid token\n", clientId)
+		context.String(401, "Unauthorized")
+		return
+	}
+
+	filter := requestFilter(context)
+
+	if _, err := NewFilter(filter); err != nil {
+		context.String(400, "Filter is not valid: %s", err)
+		return
+	}
+
 	context.HTML(200, HTML_MAIN_INDEX, gin.H{
-		"clientId": clientId,
-		"domain":   options.Domain.Websocket,
+		"clientId":         clientId,
+		"token":            token,
+		"domain":           options.Domain.Websocket,
+		"xterm":            xtermAssets(),
+		"protocolVersion":  common.PROTOCOL_VERSION,
+		"capabilities":     common.Capabilities,
+		"predicatePattern": common.FIELD_PREDICATE_PATTERN,
+		"defaultStream":    common.DEFAULT_STREAM,
+		"filter":           filter,
+		"filtered":         !filter.IsEmpty(),
 	})
 }
+
+// requestToken reads the session read token either from the query string or the Authorization header
+func requestToken(context *gin.Context) string {
+	if token := context.Query("token"); token != "" {
+		return token
+	}
+
+	return bearerToken(context)
+}
+
+// requestFilter reads the filter of a subscriber from the query, every parameter can be repeated
+// e.g. ?include=timeout&exclude=healthcheck&field=status>=500&level=warn
+func requestFilter(context *gin.Context) *common.FilterMessage {
+	return &common.FilterMessage{
+		Include:  context.QueryArray("include"),
+		Exclude:  context.QueryArray("exclude"),
+		Contains: context.QueryArray("contains"),
+		Fields:   context.QueryArray("field"),
+		Level:    context.Query("level"),
+	}
+}
+
+// logRequest writes requests the way gin does, but without the read token of the query
+// since request logs are printed and often collected along with the rest of the logs
+func logRequest(params gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+
+	if params.IsOutputColor() {
+		statusColor = params.StatusCodeColor()
+		methodColor = params.MethodColor()
+		resetColor = params.ResetColor()
+	}
+
+	if params.Latency > time.Minute {
+		params.Latency = params.Latency.Truncate(time.Second)
+	}
+
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		params.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, params.StatusCode, resetColor,
+		params.Latency,
+		params.ClientIP,
+		methodColor, params.Method, resetColor,
+		redactToken(params.Path),
+		params.ErrorMessage,
+	)
+}
+
+// redactToken hides the token of the query string of path, the query is left out when it can't be parsed
+func redactToken(path string) string {
+	i := strings.IndexByte(path, '?')
+
+	if i < 0 {
+		return path
+	}
+
+	query, err := url.ParseQuery(path[i+1:])
+
+	if err != nil {
+		return path[:i]
+	}
+
+	if _, ok := query["token"]; !ok {
+		return path
+	}
+
+	query.Set("token", REDACTED)
+
+	return path[:i] + "?" + query.Encode()
+}
@@ -0,0 +1,20 @@
+package server
+
+import "testing"
+
+func TestRedactToken(t *testing.T) {
+	paths := map[string]string{
+		"/client/abc":                             "/client/abc",
+		"/client/abc?level=warn":                  "/client/abc?level=warn",
+		"/client/abc?token=secret":                "/client/abc?token=" + REDACTED,
+		"/client/abc/raw?token=secret&ansi=strip": "/client/abc/raw?ansi=strip&token=" + REDACTED,
+		"/client/abc?token=secret&token=other":    "/client/abc?token=" + REDACTED,
+		"/client/abc?token=%zz":                   "/client/abc",
+	}
+
+	for path, expected := range paths {
+		if redacted := redactToken(path); redacted != expected {
+			t.Errorf("redacting %q gave %q, expected %q", path, redacted, expected)
+		}
+	}
+}
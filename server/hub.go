@@ -1,131 +1,636 @@
 package server
 
 import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
 	"go.uber.org/zap"
 )
 
-// Maintain the set of active clients
+// Sessions are spread over HUB_SHARDS shards, each with its own lock
+// so broadcasters of different sessions rarely wait for each other
+const HUB_SHARDS = 32
+
+// Hub keeps track of the broadcaster and subscribers of every session
+// every method is safe to be called from any goroutine
 type Hub struct {
-	clients    map[string]*Client
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan struct {
-		message  []byte
-		clientId string
+	shards  [HUB_SHARDS]*shard
+	storage *Storage
+}
+
+type shard struct {
+	mu       sync.Mutex
+	sessions map[string]*peers
+}
+
+// peers are the clients of a single session, session is only set once a broadcaster claimed the ID
+// subscribers can still be there without it when they're reading a stored session
+type peers struct {
+	session     *Session
+	broadcaster *Client
+	subscribers map[*Client]struct{}
+}
+
+// storage is optional, when it is nil sessions only live in memory
+func NewHub(storage *Storage) *Hub {
+	h := &Hub{
+		storage: storage,
+	}
+
+	for i := range h.shards {
+		h.shards[i] = &shard{
+			sessions: make(map[string]*peers),
+		}
 	}
-	send chan struct {
-		message  []byte
-		clientId string
+
+	return h
+}
+
+// lock returns the shard of the session locked, it must be unlocked by the caller
+func (h *Hub) lock(id string) *shard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(id))
+
+	s := h.shards[hash.Sum32()%HUB_SHARDS]
+	s.mu.Lock()
+
+	return s
+}
+
+func (s *shard) peers(id string) *peers {
+	p, ok := s.sessions[id]
+
+	if !ok {
+		p = &peers{
+			subscribers: make(map[*Client]struct{}),
+		}
+		s.sessions[id] = p
 	}
-	update chan struct {
-		id     string
-		client *Client
+
+	return p
+}
+
+// cleanup forgets the session once nothing is left of it
+func (s *shard) cleanup(id string) {
+	p, ok := s.sessions[id]
+
+	if ok && p.session == nil && p.broadcaster == nil && len(p.subscribers) == 0 {
+		delete(s.sessions, id)
 	}
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast: make(chan struct {
-			message  []byte
-			clientId string
-		}),
-		send: make(chan struct {
-			message  []byte
-			clientId string
-		}),
-		update: make(chan struct {
-			id     string
-			client *Client
-		}),
+// Lookup returns the live session of a broadcaster
+func (h *Hub) Lookup(id string) *Session {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	if p, ok := s.sessions[id]; ok {
+		return p.session
 	}
+
+	return nil
 }
 
-// removeChannel is a flag must be set to true to remove client send channel
-// This flag is added to avoid removing client channel when updating the client
-func (h *Hub) RemoveClient(clientId string, removeChannel bool) {
-	if client, ok := hub.clients[clientId]; ok {
-		zap.S().Infow("Removing client",
-			"clientId", clientId,
-			"removeChannel", removeChannel)
+// Authorize checks the read token of either a live or a stored session
+func (h *Hub) Authorize(clientId string, token string) bool {
+	if session := h.Lookup(clientId); session != nil {
+		return session.Authorize(token)
+	}
 
-		delete(hub.clients, clientId)
-		if removeChannel {
-			close(client.send)
-		}
+	if h.storage == nil {
+		return false
 	}
+
+	meta, err := h.storage.LoadMeta(clientId)
+
+	if err != nil {
+		return false
+	}
+
+	return common.TokenMatches(token, meta.TokenHash)
+}
+
+// SessionExists checks if clientId is a live session or a session kept on the storage
+func (h *Hub) SessionExists(clientId string) bool {
+	if h.Lookup(clientId) != nil {
+		return true
+	}
+
+	return h.storage != nil && h.storage.Exists(clientId)
+}
+
+// Records returns the scrollback of a live session
+func (h *Hub) Records(clientId string) []Record {
+	s := h.lock(clientId)
+	defer s.mu.Unlock()
+
+	if p, ok := s.sessions[clientId]; ok && p.session != nil {
+		return p.session.scrollback.Records()
+	}
+
+	return nil
+}
+
+// announceSession lets the broadcaster know about its session, that's the only time
+// the read token is sent so it can be embedded into the shareable link
+func (h *Hub) announceSession(client *Client, session *Session) {
+	message := common.Message{
+		Id:    client.id,
+		Event: common.EVENT_SESSION,
+		Payload: common.SessionMessage{
+			Token:   session.token,
+			Secret:  session.secret,
+			LastSeq: session.seq,
+		},
+	}
+
+	data, err := message.Marshal()
+
+	if err != nil {
+		return
+	}
+
+	session.token = ""
+	session.secret = ""
+	client.enqueue(data, 0)
 }
 
-func (h *Hub) RemoveActiveSubscribers(clientId string) {
-	for _, c := range h.clients {
-		if c.IsActiveSubscriber() && c.peerId == clientId {
-			h.RemoveClient(c.id, true)
+func (h *Hub) verifyOwnership(s *shard, id string, secret string) error {
+	var secretHash string
+
+	if p, ok := s.sessions[id]; ok && p.session != nil {
+		secretHash = p.session.secretHash
+	} else if h.storage != nil && h.storage.Exists(id) {
+		meta, err := h.storage.LoadMeta(id)
+
+		if err != nil {
+			zap.L().Error("Error loading session meta", zap.String("id", id), zap.Error(err))
 		}
+
+		secretHash = meta.SecretHash
+	} else {
+		// Nobody owns this ID yet
+		return nil
+	}
+
+	if secret == "" {
+		return NewPeerError(common.ERROR_ID_TAKEN, "Broadcaster ID: [%s] is already owned by another broadcaster", id)
+	}
+
+	if !common.TokenMatches(secret, secretHash) {
+		return NewPeerError(common.ERROR_INVALID_SECRET, "Secret of broadcaster ID: [%s] is not valid", id)
+	}
+
+	return nil
+}
+
+// Claim binds the broadcaster ID to client, the ID can only be claimed again
+// with the secret that was issued when it was first claimed
+func (h *Hub) Claim(client *Client, id string, secret string) error {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	if err := h.verifyOwnership(s, id, secret); err != nil {
+		zap.S().Warnw("Rejecting broadcaster claim",
+			"id", client.id,
+			"claimedId", id,
+			"error", err)
+		return err
+	}
+
+	p := s.peers(id)
+
+	// The owner is reconnecting while its previous connection is still around
+	if p.broadcaster != nil && p.broadcaster != client {
+		zap.S().Infow("Replacing previous broadcaster connection", "id", id)
+		p.broadcaster.closeSend()
 	}
+
+	client.id = id
+	client.broadcaster = true
+	client.peerId = ""
+	client.active = true
+	p.broadcaster = client
+
+	if p.session == nil {
+		p.session = NewSession(id, h.storage)
+	}
+
+	if p.session.expiry != nil {
+		zap.S().Infow("Broadcaster reconnected", "id", id, "lastSeq", p.session.seq)
+		p.session.expiry.Stop()
+		p.session.expiry = nil
+	}
+
+	h.announceSession(client, p.session)
+
+	return nil
 }
 
-func (h *Hub) Run() {
-	zap.S().Debug("Created clients hub")
+// Join adds an identified subscriber to the session of its peer and replays the scrollback to it
+// lines are published under the same lock so replayed lines always come before live ones
+func (h *Hub) Join(client *Client) {
+	var stored *Session
+	loaded := false
 
 	for {
-		select {
-		case client := <-h.register:
-			zap.S().Infow("Adding client to hub",
-				"id", client.id,
-				"active", client.active,
-				"broadcaster", client.broadcaster,
-				"subscriber", client.subscriber,
-				"peerId", client.peerId)
-
-			h.clients[client.id] = client
-
-		case info := <-h.update:
-			zap.S().Infow("Updating client",
-				"id", info.id,
-				"newId", info.client.id)
-
-			h.RemoveClient(info.id, false)
-			h.clients[info.client.id] = info.client
-
-		case client := <-h.unregister:
-			zap.S().Infow("Unregistering client",
-				"id", client.id)
-
-			// In case broadcaster is disconnecting, then disconnect subscribers too
-			if client.IsActiveBroadcaster() {
-				h.RemoveActiveSubscribers(client.id)
-			}
-			h.RemoveClient(client.id, true)
-
-		case message := <-h.broadcast:
-			zap.S().Infow("Broadcasting message to peer",
-				"clientId", message.clientId)
-
-			for _, client := range h.clients {
-				if client.IsActiveSubscriber() && client.peerId == message.clientId {
-					zap.S().Debugw("Sending message to client",
-						"clientId", client.id,
-						"broadcaster", client.broadcaster,
-						"subscriber", client.subscriber,
-						"active", client.active)
-
-					client.send <- message.message
-				}
-			}
+		s := h.lock(client.peerId)
+		p := s.peers(client.peerId)
+
+		// Stored sessions are read without the lock, reading every segment would hold up the whole shard
+		if p.session == nil && !loaded && h.storage != nil && h.storage.Exists(client.peerId) {
+			s.cleanup(client.peerId)
+			s.mu.Unlock()
+
+			stored = h.loadSession(client.peerId)
+			loaded = true
+			continue
+		}
+
+		zap.S().Infow("Adding subscriber to session",
+			"id", client.id,
+			"peerId", client.peerId)
+
+		p.subscribers[client] = struct{}{}
+		h.replay(p, client, stored)
+
+		s.mu.Unlock()
+		return
+	}
+}
+
+// loadSession reads a session from the storage, it is nil when it couldn't be read
+func (h *Hub) loadSession(id string) *Session {
+	session, err := LoadSession(id, h.storage)
+
+	if err != nil {
+		zap.L().Error("Error loading session from storage", zap.String("peerId", id), zap.Error(err))
+		return nil
+	}
+
+	return session
+}
+
+// Leave removes the client from its session, it is called once its connection is gone
+func (h *Hub) Leave(client *Client) {
+	var id string
+
+	switch {
+	case client.IsActiveBroadcaster():
+		id = client.id
+	case client.IsActiveSubscriber():
+		id = client.peerId
+	default:
+		// Client never identified so nobody else knows about it
+		client.closeSend()
+		return
+	}
+
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	zap.S().Infow("Removing client",
+		"clientId", client.id,
+		"peerId", client.peerId,
+		"dropped", client.Dropped())
+
+	// Send queue is closed while holding the lock, nothing can be queued for the client anymore
+	client.closeSend()
+
+	p, ok := s.sessions[id]
+
+	if !ok {
+		return
+	}
+
+	if client.subscriber {
+		delete(p.subscribers, client)
+		s.cleanup(id)
+		return
+	}
+
+	// Broadcaster was already replaced by a new connection
+	if p.broadcaster != client {
+		return
+	}
 
-		case message := <-h.send:
-			zap.S().Infow("Sending message to peer",
-				"clientId", message.clientId)
+	p.broadcaster = nil
+	h.disconnectBroadcaster(s, id, p)
+}
+
+// replay sends broadcaster history to a newly identified subscriber, stored is the session read
+// from the storage when it wasn't live, lines sent since by a reconnected broadcaster are merged by seq
+func (h *Hub) replay(p *peers, client *Client, stored *Session) {
+	var records []Record
+
+	session := p.session
+	frames := client.CanRenderFrames()
+
+	if stored != nil {
+		records = stored.Since(client.since, frames)
+
+		if session == nil {
+			session = stored
+		}
+	}
+
+	if session == nil {
+		return
+	}
+
+	if session != stored {
+		since := client.since
+
+		if stored != nil && stored.seq > since {
+			since = stored.seq
+		}
+
+		records = append(records, session.Since(since, frames)...)
+	}
 
-			client, ok := h.clients[message.clientId]
+	zap.S().Infow("Replaying scrollback to subscriber",
+		"id", client.id,
+		"peerId", client.peerId,
+		"since", client.since,
+		"lines", len(records))
 
-			if ok {
-				client.send <- message.message
+	for _, record := range records {
+		if !client.filter.Match(record, nil) {
+			continue
+		}
+
+		message, err := record.Marshal(session.id)
+
+		if err != nil {
+			continue
+		}
+
+		if !client.enqueue(message, record.Seq) {
+			h.disconnectSlowClient(p, client)
+			return
+		}
+	}
+
+	if session.exit == nil {
+		return
+	}
+
+	message, err := session.ExitMessage()
+
+	if err != nil {
+		return
+	}
+
+	client.enqueue(message, 0)
+}
+
+// Publish appends the records to the session of the broadcaster and sends them to its subscribers
+func (h *Hub) Publish(client *Client, records ...Record) {
+	start := time.Now()
+
+	fields := make([]*LineFields, len(records))
+
+	for i, record := range records {
+		fields[i] = NewLineFields(record)
+	}
+
+	// Lines are parsed before taking the lock when subscribers filter on their fields or level,
+	// those joining in the meantime parse them while it is held, still once for all of them
+	byFields, byLevel := h.filtersLines(client.id)
+
+	for _, f := range fields {
+		if byFields {
+			f.Get()
+		}
+
+		if byLevel {
+			f.Level()
+		}
+	}
+
+	s := h.lock(client.id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[client.id]
+
+	// Broadcaster connection was replaced, its lines are resent by the new one
+	if !ok || p.broadcaster != client || p.session == nil {
+		return
+	}
+
+	defer func() {
+		publishDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	for i, record := range records {
+		h.publish(p, client, record, fields[i])
+	}
+}
+
+// filtersLines tells if any subscriber of the session filters on fields of JSON lines or on their level
+func (h *Hub) filtersLines(id string) (byFields bool, byLevel bool) {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[id]
+
+	if !ok {
+		return false, false
+	}
+
+	for subscriber := range p.subscribers {
+		byFields = byFields || subscriber.filter.HasFields()
+		byLevel = byLevel || subscriber.filter.HasLevel()
+	}
+
+	return byFields, byLevel
+}
+
+func (h *Hub) publish(p *peers, client *Client, record Record, fields *LineFields) {
+	record, ok := p.session.Append(record)
+
+	if !ok {
+		return
+	}
+
+	stats.addRecord(record)
+
+	if record.Seq%ACK_INTERVAL == 0 {
+		h.acknowledge(client, record.Seq)
+	}
+
+	data, err := record.Marshal(client.id)
+
+	if err != nil {
+		return
+	}
+
+	for subscriber := range p.subscribers {
+		if (record.IsFrame() && !subscriber.CanRenderFrames()) || !subscriber.filter.Match(record, fields) {
+			continue
+		}
+
+		if !subscriber.enqueue(data, record.Seq) {
+			h.disconnectSlowClient(p, subscriber)
+		}
+	}
+}
+
+// PublishExit records how the command of the broadcaster ended and lets its subscribers know
+func (h *Hub) PublishExit(client *Client, exit common.ProcessExitMessage) {
+	s := h.lock(client.id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[client.id]
+
+	if !ok || p.broadcaster != client || p.session == nil {
+		return
+	}
+
+	if p.session.SetExit(exit) {
+		zap.S().Infow("Broadcaster command exited",
+			"clientId", client.id,
+			"exitCode", exit.ExitCode,
+			"signal", exit.Signal)
+
+		if h.storage != nil {
+			if err := h.storage.SaveMeta(client.id, p.session.Meta()); err != nil {
+				zap.L().Error("Error storing process exit", zap.String("clientId", client.id), zap.Error(err))
 			}
+		}
+	}
 
-			zap.L().Error("Couldn't find client", zap.String("clientId", message.clientId))
+	data, err := p.session.ExitMessage()
+
+	if err != nil {
+		return
+	}
+
+	for subscriber := range p.subscribers {
+		if !subscriber.enqueue(data, 0) {
+			h.disconnectSlowClient(p, subscriber)
 		}
 	}
+
+	// Broadcaster gets the event back too, that is how it knows everything was received
+	client.enqueue(data, 0)
+}
+
+// Send delivers a message to the broadcaster of the session
+func (h *Hub) Send(id string, message []byte) {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[id]
+
+	if !ok || p.broadcaster == nil {
+		zap.L().Error("Couldn't find client", zap.String("clientId", id))
+		return
+	}
+
+	p.broadcaster.enqueue(message, 0)
+}
+
+// acknowledge tells the broadcaster which lines it doesn't need to keep anymore
+func (h *Hub) acknowledge(client *Client, seq uint64) {
+	if !common.HasCapability(client.capabilities, common.CAPABILITY_ACKS) {
+		return
+	}
+
+	message := common.Message{
+		Id:    client.id,
+		Event: common.EVENT_LOG_ACK,
+		Payload: common.AckMessage{
+			Seq: seq,
+		},
+	}
+
+	data, err := message.Marshal()
+
+	if err != nil {
+		return
+	}
+
+	client.enqueue(data, 0)
+}
+
+// disconnectSlowClient closes the connection right away instead of waiting for the queue to be written
+// the subscriber is asked to try again later so it can reconnect and resume from its last line
+func (h *Hub) disconnectSlowClient(p *peers, client *Client) {
+	zap.S().Warnw("Disconnecting subscriber that can't keep up",
+		"id", client.id,
+		"peerId", client.peerId,
+		"dropped", client.Dropped())
+
+	stats.addSlowDisconnect()
+	delete(p.subscribers, client)
+	client.closeSend()
+
+	// Writing may block until the deadline, the shard must not wait for it
+	go func() {
+		deadline := time.Now().Add(WRITE_WAIT)
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber is too slow")
+
+		if err := client.connection.WriteControl(websocket.CloseMessage, closeMessage, deadline); err != nil {
+			zap.L().Warn("Error sending close message to slow subscriber", zap.Error(err))
+		}
+
+		client.connection.Close()
+	}()
+}
+
+// disconnectBroadcaster keeps the session around for the broadcaster to reconnect
+// subscribers are only disconnected once the grace period is over
+func (h *Hub) disconnectBroadcaster(s *shard, id string, p *peers) {
+	if p.session == nil || options.ReconnectGrace <= 0 {
+		h.endSession(s, id, p)
+		return
+	}
+
+	zap.S().Infow("Waiting for broadcaster to reconnect",
+		"id", id,
+		"grace", options.ReconnectGrace)
+
+	if p.session.expiry != nil {
+		p.session.expiry.Stop()
+	}
+
+	p.session.expiry = time.AfterFunc(options.ReconnectGrace, func() {
+		h.expire(id)
+	})
+}
+
+func (h *Hub) expire(id string) {
+	s := h.lock(id)
+	defer s.mu.Unlock()
+
+	p, ok := s.sessions[id]
+
+	if !ok {
+		return
+	}
+
+	if p.broadcaster != nil {
+		zap.S().Debugw("Broadcaster is connected again, session is kept", "id", id)
+		return
+	}
+
+	h.endSession(s, id, p)
+}
+
+func (h *Hub) endSession(s *shard, id string, p *peers) {
+	zap.S().Infow("Ending session", "id", id)
+
+	for subscriber := range p.subscribers {
+		subscriber.closeSend()
+	}
+
+	if p.session != nil {
+		p.session.Close()
+	}
+
+	delete(s.sessions, id)
 }
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+)
+
+const (
+	RACE_SESSION_ID  = "race"
+	RACE_LINES       = 2000
+	RACE_BATCH_SIZE  = 20
+	RACE_SUBSCRIBERS = 8
+	RACE_CHURNERS    = 4
+	// Replays are kept short so joins don't hold the shard for long, late subscribers start at the scrollback
+	RACE_SCROLLBACK = 200
+	// Batches are spread over time so subscribers join and leave while lines are being published
+	RACE_BATCH_INTERVAL = time.Millisecond
+)
+
+const (
+	// Sessions of the many sessions test, enough for every shard to hold several of them
+	MANY_SESSIONS    = 256
+	MANY_LINES       = 100
+	MANY_SUBSCRIBERS = 2
+	// One session out of MANY_TERMINATED is terminated by an administrator halfway
+	MANY_TERMINATED = 8
+)
+
+// received is what a subscriber of the test got, it is checked once its queue was closed
+type received struct {
+	client *Client
+	seqs   []uint64
+	done   chan struct{}
+}
+
+func setTestOptions(grace time.Duration) {
+	options = &ServerOptions{
+		Domain:               &common.Domain{},
+		ScrollbackLines:      RACE_SCROLLBACK,
+		SendQueueSize:        4 * RACE_LINES,
+		SlowSubscriberPolicy: POLICY_DROP_NEWEST,
+		ReconnectGrace:       grace,
+	}
+}
+
+func newTestClient(id string) *Client {
+	return &Client{
+		id:          id,
+		connectedAt: time.Now(),
+		// Queue never fills up, a dropped line would be reported as lost
+		send: make(chan []byte, options.SendQueueSize),
+	}
+}
+
+// newSubscriber creates a subscriber of the session and reads its queue until it is closed
+func newSubscriber(peerId string, id string) *received {
+	client := newTestClient(id)
+	client.peerId = peerId
+	client.subscriber = true
+	client.active = true
+
+	r := &received{
+		client: client,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		for data := range client.send {
+			var message struct {
+				Event   string `json:"event"`
+				Payload struct {
+					Seq uint64 `json:"seq"`
+				} `json:"payload"`
+			}
+
+			if json.Unmarshal(data, &message) == nil && message.Event == common.EVENT_LOG_LINE {
+				r.seqs = append(r.seqs, message.Payload.Seq)
+			}
+		}
+	}()
+
+	return r
+}
+
+// subscribe joins a new subscriber to the session
+func subscribe(h *Hub, peerId string, id string) *received {
+	r := newSubscriber(peerId, id)
+	h.Join(r.client)
+
+	return r
+}
+
+// claimSession makes a new broadcaster claim the session, it returns the secret sent to it the first time
+func claimSession(h *Hub, id string, secret string) (*Client, string, error) {
+	client := newTestClient(common.GenerateUUID())
+
+	if err := h.Claim(client, id, secret); err != nil {
+		return nil, "", fmt.Errorf("claiming session: %w", err)
+	}
+
+	var message struct {
+		Payload common.SessionMessage `json:"payload"`
+	}
+
+	if err := json.Unmarshal(<-client.send, &message); err != nil {
+		return nil, "", fmt.Errorf("reading session: %w", err)
+	}
+
+	return client, common.WinningDefault(message.Payload.Secret, secret), nil
+}
+
+func claim(t *testing.T, h *Hub, id string, secret string) (*Client, string) {
+	client, secret, err := claimSession(h, id, secret)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, secret
+}
+
+// publish sends lines from..to in batches, the broadcaster reconnects halfway when secret is set
+func publish(t *testing.T, h *Hub, broadcaster *Client, secret string, from uint64, to uint64) *Client {
+	for seq := from; seq <= to; seq += RACE_BATCH_SIZE {
+		if secret != "" && seq > (from+to)/2 && seq-RACE_BATCH_SIZE <= (from+to)/2 {
+			previous := broadcaster
+			broadcaster, _ = claim(t, h, broadcaster.id, secret)
+			h.Leave(previous)
+		}
+
+		var records []Record
+
+		for i := seq; i < seq+RACE_BATCH_SIZE && i <= to; i++ {
+			records = append(records, Record{Seq: i, Line: fmt.Sprintf("line %d", i)})
+		}
+
+		h.Publish(broadcaster, records...)
+		time.Sleep(RACE_BATCH_INTERVAL)
+	}
+
+	return broadcaster
+}
+
+// churn keeps joining and leaving the session until stop is closed, it returns what every subscriber got
+func churn(h *Hub, stop chan struct{}) []*received {
+	var results []*received
+
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return results
+		default:
+		}
+
+		r := subscribe(h, RACE_SESSION_ID, common.GenerateUUID())
+		time.Sleep(time.Duration(i%3) * RACE_BATCH_INTERVAL)
+		h.Leave(r.client)
+		<-r.done
+		results = append(results, r)
+		time.Sleep(RACE_BATCH_INTERVAL)
+	}
+}
+
+// checkReceived makes sure lines came in order without gaps, complete subscribers must have every line up to last
+func checkReceived(t *testing.T, name string, r *received, last uint64, complete bool) {
+	for i := 1; i < len(r.seqs); i++ {
+		if r.seqs[i] != r.seqs[i-1]+1 {
+			t.Fatalf("%s received line %d after line %d", name, r.seqs[i], r.seqs[i-1])
+		}
+	}
+
+	if !complete {
+		return
+	}
+
+	if len(r.seqs) == 0 || r.seqs[len(r.seqs)-1] != last {
+		t.Fatalf("%s didn't receive every line up to %d, it got %d lines", name, last, len(r.seqs))
+	}
+}
+
+// race runs the broadcaster, subscribers joining along the way and subscribers that keep
+// joining and leaving at the same time, publish is what the broadcaster does
+func race(t *testing.T, h *Hub, last uint64, publish func()) {
+	stop := make(chan struct{})
+	subscribers := make(chan *received, RACE_SUBSCRIBERS)
+
+	var churners sync.WaitGroup
+	var mu sync.Mutex
+	var churned []*received
+
+	for i := 0; i < RACE_CHURNERS; i++ {
+		churners.Add(1)
+
+		go func(i int) {
+			defer churners.Done()
+
+			// Churners are staggered so some of them are always in the middle of joining
+			time.Sleep(time.Duration(i) * 3 * RACE_BATCH_INTERVAL)
+			results := churn(h, stop)
+
+			mu.Lock()
+			churned = append(churned, results...)
+			mu.Unlock()
+		}(i)
+	}
+
+	var joined sync.WaitGroup
+
+	for i := 0; i < RACE_SUBSCRIBERS; i++ {
+		joined.Add(1)
+
+		go func(i int) {
+			defer joined.Done()
+			time.Sleep(time.Duration(i) * 10 * RACE_BATCH_INTERVAL)
+			subscribers <- subscribe(h, RACE_SESSION_ID, fmt.Sprintf("subscriber-%d", i))
+		}(i)
+	}
+
+	publish()
+	joined.Wait()
+	close(stop)
+	churners.Wait()
+	close(subscribers)
+
+	for _, r := range churned {
+		checkReceived(t, "churned subscriber "+r.client.id, r, last, false)
+	}
+
+	for r := range subscribers {
+		h.Leave(r.client)
+		<-r.done
+		checkReceived(t, r.client.id, r, last, true)
+	}
+}
+
+func TestHubConcurrentSubscribers(t *testing.T) {
+	setTestOptions(time.Minute)
+
+	h := NewHub(nil)
+	broadcaster, secret := claim(t, h, RACE_SESSION_ID, "")
+
+	race(t, h, RACE_LINES, func() {
+		broadcaster = publish(t, h, broadcaster, secret, 1, RACE_LINES)
+	})
+
+	h.Leave(broadcaster)
+}
+
+func TestHubConcurrentStoredSession(t *testing.T) {
+	setTestOptions(0)
+
+	storage, err := NewStorage(t.TempDir(), 1024*1024, 0)
+
+	if err != nil {
+		t.Fatalf("creating storage: %v", err)
+	}
+
+	h := NewHub(storage)
+	broadcaster, secret := claim(t, h, RACE_SESSION_ID, "")
+	publish(t, h, broadcaster, "", 1, RACE_LINES)
+
+	// Session only exists on the storage now, subscribers replay it while the broadcaster claims it again
+	h.Leave(broadcaster)
+
+	race(t, h, 2*RACE_LINES, func() {
+		// Subscribers are reading the stored session by then, lines sent meanwhile must be merged
+		time.Sleep(10 * RACE_BATCH_INTERVAL)
+		broadcaster, _ = claim(t, h, RACE_SESSION_ID, secret)
+		broadcaster = publish(t, h, broadcaster, secret, RACE_LINES+1, 2*RACE_LINES)
+	})
+
+	h.Leave(broadcaster)
+}
+
+func TestHubReplayMergesStoredSession(t *testing.T) {
+	setTestOptions(0)
+
+	storage, err := NewStorage(t.TempDir(), 1024*1024, 0)
+
+	if err != nil {
+		t.Fatalf("creating storage: %v", err)
+	}
+
+	h := NewHub(storage)
+	broadcaster, secret := claim(t, h, RACE_SESSION_ID, "")
+	publish(t, h, broadcaster, "", 1, RACE_SCROLLBACK)
+	h.Leave(broadcaster)
+
+	// Same steps as Join, the broadcaster comes back while the stored session is being read
+	stored := h.loadSession(RACE_SESSION_ID)
+	broadcaster, _ = claim(t, h, RACE_SESSION_ID, secret)
+	publish(t, h, broadcaster, "", RACE_SCROLLBACK+1, RACE_SCROLLBACK+RACE_BATCH_SIZE)
+
+	r := newSubscriber(RACE_SESSION_ID, "subscriber")
+	s := h.lock(RACE_SESSION_ID)
+	p := s.peers(RACE_SESSION_ID)
+	p.subscribers[r.client] = struct{}{}
+	h.replay(p, r.client, stored)
+	s.mu.Unlock()
+
+	h.Leave(r.client)
+	<-r.done
+	checkReceived(t, r.client.id, r, RACE_SCROLLBACK+RACE_BATCH_SIZE, true)
+
+	h.Leave(broadcaster)
+}
+
+// runSession runs the broadcaster and subscribers of one session among many, a subscriber joins
+// halfway and another one leaves right after joining, complete subscribers must get every line
+func runSession(h *Hub, id string, terminate bool) (complete []*received, partial []*received, err error) {
+	broadcaster, _, err := claimSession(h, id, "")
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := 0; i < MANY_SUBSCRIBERS; i++ {
+		complete = append(complete, subscribe(h, id, fmt.Sprintf("%s-subscriber-%d", id, i)))
+	}
+
+	for seq := uint64(1); seq <= MANY_LINES; seq += RACE_BATCH_SIZE {
+		if seq > MANY_LINES/2 && seq-RACE_BATCH_SIZE <= MANY_LINES/2 {
+			complete = append(complete, subscribe(h, id, id+"-late"))
+
+			churned := subscribe(h, id, id+"-churned")
+			h.Leave(churned.client)
+			<-churned.done
+			partial = append(partial, churned)
+
+			if terminate {
+				h.Terminate(id)
+			}
+		}
+
+		var records []Record
+
+		for i := seq; i < seq+RACE_BATCH_SIZE && i <= MANY_LINES; i++ {
+			records = append(records, Record{Seq: i, Line: fmt.Sprintf("line %d", i)})
+		}
+
+		h.Publish(broadcaster, records...)
+		time.Sleep(RACE_BATCH_INTERVAL)
+	}
+
+	// Session ends with its broadcaster, queues of its subscribers are closed
+	h.Leave(broadcaster)
+
+	for _, r := range complete {
+		<-r.done
+		h.Leave(r.client)
+	}
+
+	if terminate {
+		return nil, append(partial, complete...), nil
+	}
+
+	return complete, partial, nil
+}
+
+func TestHubManySessions(t *testing.T) {
+	setTestOptions(0)
+
+	storage, err := NewStorage(t.TempDir(), 1024*1024, 0)
+
+	if err != nil {
+		t.Fatalf("creating storage: %v", err)
+	}
+
+	h := NewHub(storage)
+	ids := make([]string, MANY_SESSIONS)
+	shards := make(map[*shard]bool)
+
+	for i := range ids {
+		ids[i] = fmt.Sprintf("session-%d", i)
+
+		s := h.lock(ids[i])
+		shards[s] = true
+		s.mu.Unlock()
+	}
+
+	if len(shards) != HUB_SHARDS {
+		t.Fatalf("sessions only landed on %d of %d shards", len(shards), HUB_SHARDS)
+	}
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+
+	readers.Add(1)
+
+	// Metrics and the admin API walk every shard while sessions come and go
+	go func() {
+		defer readers.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			h.Counts()
+
+			for _, info := range h.Sessions() {
+				h.Session(info.Id)
+			}
+
+			// Storage is closed like on shutdown, lines are still published without being stored
+			if i == 10 {
+				h.Close()
+			}
+
+			time.Sleep(RACE_BATCH_INTERVAL)
+		}
+	}()
+
+	var sessions sync.WaitGroup
+	var mu sync.Mutex
+	var complete, partial []*received
+
+	for i, id := range ids {
+		sessions.Add(1)
+
+		go func(id string, terminate bool) {
+			defer sessions.Done()
+
+			c, p, err := runSession(h, id, terminate)
+
+			if err != nil {
+				t.Errorf("running session %s: %v", id, err)
+				return
+			}
+
+			mu.Lock()
+			complete = append(complete, c...)
+			partial = append(partial, p...)
+			mu.Unlock()
+		}(id, i%MANY_TERMINATED == 0)
+	}
+
+	sessions.Wait()
+	close(stop)
+	readers.Wait()
+
+	for _, r := range complete {
+		checkReceived(t, r.client.id, r, MANY_LINES, true)
+	}
+
+	for _, r := range partial {
+		checkReceived(t, r.client.id, r, MANY_LINES, false)
+	}
+
+	if counts := h.Counts(); counts != (HubCounts{}) {
+		t.Fatalf("peers are left once every session ended: %+v", counts)
+	}
+}
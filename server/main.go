@@ -3,6 +3,7 @@ package server
 import (
 	_ "embed"
 	"fmt"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/omarahm3/squirrel/internal/pkg/common"
@@ -27,10 +28,21 @@ func printOptions() {
 		"Env", options.Env,
 		"Public Domain", options.Domain.Public,
 		"Websocket Domain", options.Domain.Websocket,
+		"Base Path", options.BasePath,
 		"Port", options.Port,
 		"Log Level", options.LogLevel.String(),
 		"Read Buffer Size", options.ReadBufferSize,
 		"Write Buffer Size", options.WriteBufferSize,
+		"Scrollback Lines", options.ScrollbackLines,
+		"Scrollback Bytes", options.ScrollbackBytes,
+		"Storage Directory", options.StorageDir,
+		"Storage Segment Size", options.StorageSegmentSize,
+		"Storage Retention", options.StorageRetention,
+		"Reconnect Grace", options.ReconnectGrace,
+		"Shutdown Timeout", options.ShutdownTimeout,
+		"Shutdown Reconnect Delay", options.ShutdownReconnectDelay,
+		"TLS", options.TLSCert != "",
+		"Mutual TLS", options.TLSClientCA != "",
 	)
 }
 
@@ -55,19 +67,33 @@ func Main() {
 		_ = zap.S().Sync()
 	}()
 
-	server = gin.Default()
+	// Same as gin.Default, except the logger leaves read tokens out
+	server = gin.New()
+	server.Use(gin.LoggerWithFormatter(logRequest), gin.Recovery())
+
+	var err error
 
 	zap.S().Debug("Prepared server default")
 
-	hub = NewHub()
+	var storage *Storage
 
-	zap.S().Debug("Created clients hub")
+	if options.StorageDir != "" {
+		storage, err = NewStorage(options.StorageDir, options.StorageSegmentSize, options.StorageRetention)
+
+		if err != nil {
+			common.FatalError("Error while initializing session storage", err)
+		}
+
+		go storage.RunRetention()
+	}
 
-	go hub.Run()
+	hub = NewHub(storage)
+
+	zap.S().Debug("Created clients hub")
 
 	zap.S().Debug("Loading server HTML files")
 
-	err := common.LoadHtmlTemplates(server, map[string]string{
+	err = common.LoadHtmlTemplates(server, map[string]string{
 		HTML_MAIN_INDEX: mainHtmlView,
 	})
 
@@ -79,11 +105,18 @@ func Main() {
 
 	zap.S().Debugf("Running server on port [%d]\n", options.Port)
 
-	err = server.Run(fmt.Sprintf(":%d", options.Port))
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", options.Port),
+		Handler: server,
+	}
 
-	if err != nil {
-		common.FatalError("Error while running server", err)
+	if options.TLSCert != "" {
+		httpServer.TLSConfig, err = NewTLSConfig()
+
+		if err != nil {
+			common.FatalError("Error while loading TLS certificate", err)
+		}
 	}
 
-	fmt.Printf("Server is running on http://localhost:%d", options.Port)
+	serve(httpServer)
 }
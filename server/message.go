@@ -2,7 +2,7 @@ package server
 
 import (
 	"errors"
-	"fmt"
+	"sync/atomic"
 
 	"github.com/omarahm3/squirrel/internal/pkg/common"
 	"go.uber.org/zap"
@@ -15,13 +15,107 @@ func HandleLogMessage(message common.LogMessage, client *Client) {
 		"clientId", client.id,
 	)
 
-	client.hub.broadcast <- struct {
-		message  []byte
-		clientId string
-	}{
-		message:  []byte(message.Line),
-		clientId: client.id,
+	client.hub.Publish(client, Record{
+		Seq:        message.Seq,
+		Stream:     message.Stream,
+		Line:       message.Line,
+		Structured: message.Structured,
+		Truncated:  message.Truncated,
+	})
+}
+
+func HandleLogLinesMessage(message common.LogLinesMessage, client *Client) {
+	zap.S().Debugw(
+		"Sending batch of log lines",
+		"lines", len(message.Lines),
+		"clientId", client.id,
+	)
+
+	records := make([]Record, len(message.Lines))
+
+	for i, line := range message.Lines {
+		records[i] = Record{
+			Seq:        line.Seq,
+			Stream:     line.Stream,
+			Line:       line.Line,
+			Structured: line.Structured,
+			Truncated:  line.Truncated,
+		}
 	}
+
+	client.hub.Publish(client, records...)
+}
+
+func HandleTermFrameMessage(message common.TermFrameMessage, client *Client) {
+	zap.S().Debugw(
+		"Sending new terminal frame",
+		"size", len(message.Data),
+		"clientId", client.id,
+	)
+
+	client.hub.Publish(client, Record{
+		Seq:    message.Seq,
+		Stream: common.TERMINAL_STREAM,
+		Data:   message.Data,
+		Offset: message.Offset,
+		Cols:   message.Cols,
+		Rows:   message.Rows,
+	})
+}
+
+func HandleProcessExitMessage(message common.ProcessExitMessage, client *Client) {
+	zap.S().Debugw(
+		"Handling process exit message",
+		"clientId", client.id,
+		"command", message.Command,
+		"exitCode", message.ExitCode,
+	)
+
+	client.hub.PublishExit(client, message)
+}
+
+func HandleHelloMessage(payload common.HelloMessage, client *Client) error {
+	zap.S().Debugw(
+		"Handling hello message",
+		"clientId", client.id,
+		"version", payload.Version,
+		"minVersion", payload.MinVersion,
+		"capabilities", payload.Capabilities,
+	)
+
+	version, ok := common.NegotiateVersion(payload)
+
+	if !ok {
+		return NewPeerError(
+			common.ERROR_INCOMPATIBLE_VERSION,
+			"Protocol version [%d] is not supported, server supports versions [%d] to [%d]",
+			payload.Version,
+			common.MIN_PROTOCOL_VERSION,
+			common.PROTOCOL_VERSION,
+		)
+	}
+
+	client.setProtocol(version, common.NegotiateCapabilities(common.Capabilities, payload.Capabilities))
+
+	reply := common.Message{
+		Id:    client.id,
+		Event: common.EVENT_HELLO,
+		Payload: common.HelloMessage{
+			Version:        client.version,
+			Capabilities:   client.capabilities,
+			MaxMessageSize: options.MaxMessageSize,
+		},
+	}
+
+	data, err := reply.Marshal()
+
+	if err != nil {
+		return err
+	}
+
+	client.enqueue(data, 0)
+
+	return nil
 }
 
 func HandleIdentityMessage(payload common.IdentityMessage, client *Client, message common.Message) error {
@@ -33,21 +127,28 @@ func HandleIdentityMessage(payload common.IdentityMessage, client *Client, messa
 		"subscriber", payload.Subscriber,
 	)
 
-	var updateId string
-
 	// In case this is a broadcaster peer
 	if payload.Broadcaster {
 		zap.S().Debugw(
-			"Preparing broadcaster client",
-			"updateId", client.id,
-			"broadcaster", payload.Broadcaster,
-			"subscriber", payload.Subscriber,
+			"Claiming broadcaster ID",
+			"id", client.id,
+			"claimedId", message.Id,
 		)
 
-		updateId = client.id
-		client.id = message.Id
-		client.broadcaster = payload.Broadcaster
-		client.peerId = ""
+		if message.Id == "" {
+			return NewPeerError(common.ERROR_NOT_FOUND, "Broadcaster identity was sent without an ID")
+		}
+
+		// Only peers with a certificate signed by the client CA can broadcast once mutual TLS is enabled
+		if options.TLSClientCA != "" && client.certificate == nil {
+			return NewPeerError(common.ERROR_UNAUTHORIZED, "Broadcaster must present a client certificate trusted by the server")
+		}
+
+		err := client.hub.Claim(client, message.Id, payload.Secret)
+
+		if err != nil {
+			return err
+		}
 	} else {
 		zap.S().Debugw(
 			"Preparing remote client",
@@ -61,24 +162,52 @@ func HandleIdentityMessage(payload common.IdentityMessage, client *Client, messa
 			return nil
 		}
 
-		updateId = client.id
-		client.peerId = payload.PeerId
-		client.subscriber = payload.Subscriber
-	}
+		// Only subscribers receive lines and count as such, anything else would be fanned out to for nothing
+		if !payload.Subscriber {
+			zap.S().Warn("Remote client identity is neither a broadcaster nor a subscriber, discarding...")
+			return nil
+		}
 
-	zap.S().Debug("Setting client as active")
+		if !client.hub.SessionExists(payload.PeerId) {
+			return NewPeerError(common.ERROR_NOT_FOUND, "Client ID: [%s] doesn't exist on the hub", payload.PeerId)
+		}
 
-	client.active = true
+		if !client.hub.Authorize(payload.PeerId, payload.Token) {
+			return NewPeerError(common.ERROR_UNAUTHORIZED, "Client ID: [%s] is not authorized to subscribe to [%s]", client.id, payload.PeerId)
+		}
 
-	client.hub.update <- struct {
-		id     string
-		client *Client
-	}{updateId, client}
+		filter, err := NewFilter(payload.Filter)
 
-	if client.IsActiveSubscriber() {
-		if _, ok := client.hub.clients[client.peerId]; !ok {
-			return fmt.Errorf("Client ID: [%s] doesn't exist on the hub", client.peerId)
+		if err != nil {
+			return NewPeerError(common.ERROR_INVALID_FILTER, "Filter is not valid: %s", err)
 		}
+
+		// Policy of the identity takes over the one the subscriber connected with
+		if payload.SlowPolicy != "" {
+			if !isSlowSubscriberPolicy(payload.SlowPolicy) {
+				return NewPeerError(
+					common.ERROR_INVALID_POLICY,
+					"Slow subscriber policy [%s] is not valid, it must be one of %s, %s or %s",
+					payload.SlowPolicy,
+					POLICY_DROP_OLDEST,
+					POLICY_DROP_NEWEST,
+					POLICY_DISCONNECT,
+				)
+			}
+
+			client.setPolicy(payload.SlowPolicy)
+		}
+
+		client.peerId = payload.PeerId
+		client.subscriber = true
+		client.since = payload.Since
+		client.filter = filter
+
+		zap.S().Debug("Setting client as active")
+
+		client.active = true
+
+		client.hub.Join(client)
 	}
 
 	zap.S().Debugw(
@@ -95,7 +224,37 @@ func HandleIdentityMessage(payload common.IdentityMessage, client *Client, messa
 
 func HandleMessage(client *Client, message common.Message) (common.Message, error) {
 	switch message.Event {
-	case EVENT_IDENTITY:
+	case common.EVENT_HELLO:
+		if client.version != 0 {
+			zap.L().Warn("Client already said hello, ignoring message")
+			return message, nil
+		}
+
+		helloMessage, err := message.ToHelloMessage()
+
+		if err != nil {
+			return common.Message{}, err
+		}
+
+		err = HandleHelloMessage(helloMessage, client)
+
+		if err != nil {
+			return common.Message{}, err
+		}
+
+	case common.EVENT_IDENTITY:
+		// Client is already part of a session, its identity can't change anymore
+		if client.active {
+			zap.L().Warn("Client already sent its identity, ignoring message")
+			return message, nil
+		}
+
+		// Peers from before the handshake was introduced start with identity
+		if client.version == 0 {
+			zap.S().Debugw("Client didn't say hello, assuming first protocol version", "clientId", client.id)
+			client.setProtocol(1, nil)
+		}
+
 		identityMessage, err := message.ToIdentityMessage()
 
 		if err != nil {
@@ -108,7 +267,7 @@ func HandleMessage(client *Client, message common.Message) (common.Message, erro
 			return common.Message{}, err
 		}
 
-	case EVENT_LOG_LINE:
+	case common.EVENT_LOG_LINE:
 		if !client.active {
 			zap.L().Warn("Client is not active yet, ignoring message")
 			return common.Message{}, errors.New("Client is not active yet, ignoring messages")
@@ -123,6 +282,69 @@ func HandleMessage(client *Client, message common.Message) (common.Message, erro
 		}
 
 		HandleLogMessage(logMessage, client)
+
+	case common.EVENT_LOG_LINES:
+		if !client.active {
+			zap.L().Warn("Client is not active yet, ignoring message")
+			return common.Message{}, errors.New("Client is not active yet, ignoring messages")
+		}
+
+		linesMessage, err := message.ToLogLinesMessage()
+
+		if err != nil {
+			return common.Message{}, err
+		}
+
+		HandleLogLinesMessage(linesMessage, client)
+
+	case common.EVENT_TERM_FRAME:
+		if !client.active {
+			zap.L().Warn("Client is not active yet, ignoring message")
+			return common.Message{}, errors.New("Client is not active yet, ignoring messages")
+		}
+
+		frameMessage, err := message.ToTermFrameMessage()
+
+		if err != nil {
+			return common.Message{}, err
+		}
+
+		HandleTermFrameMessage(frameMessage, client)
+
+	case common.EVENT_PROCESS_EXIT:
+		if !client.IsActiveBroadcaster() {
+			zap.L().Warn("Only broadcasters can publish their process exit, ignoring message")
+			return message, nil
+		}
+
+		exitMessage, err := message.ToProcessExitMessage()
+
+		if err != nil {
+			return common.Message{}, err
+		}
+
+		HandleProcessExitMessage(exitMessage, client)
+
+	case common.EVENT_LOG_ACK:
+		if !client.IsActiveSubscriber() {
+			zap.L().Warn("Only subscribers can acknowledge lines, ignoring message")
+			return message, nil
+		}
+
+		ackMessage, err := message.ToAckMessage()
+
+		if err != nil {
+			return common.Message{}, err
+		}
+
+		zap.S().Debugw("Subscriber acknowledged lines", "id", client.id, "peerId", client.peerId, "seq", ackMessage.Seq)
+
+		atomic.StoreUint64(&client.acked, ackMessage.Seq)
+
+	default:
+		if !common.IsKnownEvent(message.Event) {
+			zap.S().Warnw("Ignoring unknown event", "clientId", client.id, "event", message.Event)
+		}
 	}
 
 	return message, nil
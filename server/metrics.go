@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Content type of the Prometheus text format
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	writeDuration   = NewHistogram(0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5)
+	publishDuration = NewHistogram(0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1)
+	frameSize       = NewHistogram(256, 1024, 4096, 16384, 65536, 262144, 1048576)
+)
+
+// Histogram counts observations into cumulative buckets, like Prometheus histograms
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram creates a histogram with the upper bounds of its buckets in increasing order
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += value
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, name, help, "histogram")
+
+	for i, bucket := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bucket), h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// HubCounts are the peers connected to the hub at some point in time
+type HubCounts struct {
+	Sessions     int
+	Broadcasters int
+	Subscribers  int
+}
+
+// Counts walks every shard, sessions waiting for their broadcaster to reconnect are counted too
+func (h *Hub) Counts() HubCounts {
+	var counts HubCounts
+
+	for _, s := range h.shards {
+		s.mu.Lock()
+
+		for _, p := range s.sessions {
+			if p.session != nil {
+				counts.Sessions++
+			}
+
+			if p.broadcaster != nil {
+				counts.Broadcasters++
+			}
+
+			counts.Subscribers += len(p.subscribers)
+		}
+
+		s.mu.Unlock()
+	}
+
+	return counts
+}
+
+// MetricsHandler exposes the stats of the server in the Prometheus text format
+func MetricsHandler(context *gin.Context) {
+	var w bytes.Buffer
+
+	snapshot := stats.Snapshot()
+	counts := hub.Counts()
+
+	writeMetric(&w, "squirreld_sessions", "Sessions kept by the server, including ones waiting for their broadcaster to reconnect", "gauge", float64(counts.Sessions))
+	writeMetric(&w, "squirreld_broadcasters", "Connected broadcasters", "gauge", float64(counts.Broadcasters))
+	writeMetric(&w, "squirreld_subscribers", "Connected subscribers", "gauge", float64(counts.Subscribers))
+	writeMetric(&w, "squirreld_connections", "Open websocket connections", "gauge", float64(snapshot.OpenConnections))
+	writeMetric(&w, "squirreld_connections_total", "Accepted websocket connections", "counter", float64(snapshot.Connections))
+	writeMetric(&w, "squirreld_lines_received_total", "Lines published by broadcasters", "counter", float64(snapshot.LinesReceived))
+	writeMetric(&w, "squirreld_terminal_frames_received_total", "Terminal frames published by broadcasters", "counter", float64(snapshot.FramesReceived))
+	writeMetric(&w, "squirreld_messages_received_total", "Websocket messages read from peers", "counter", float64(snapshot.MessagesReceived))
+	writeMetric(&w, "squirreld_received_bytes_total", "Bytes of websocket messages read from peers, before decompression", "counter", float64(snapshot.BytesReceived))
+	writeMetric(&w, "squirreld_messages_sent_total", "Messages written to peers", "counter", float64(snapshot.MessagesSent))
+	writeMetric(&w, "squirreld_sent_bytes_total", "Bytes of messages written to peers, before compression", "counter", float64(snapshot.BytesSent))
+	writeMetric(&w, "squirreld_dropped_messages_total", "Messages that were never sent because a peer couldn't keep up", "counter", float64(snapshot.DroppedMessages))
+	writeMetric(&w, "squirreld_slow_disconnects_total", "Subscribers disconnected for not keeping up", "counter", float64(snapshot.SlowDisconnects))
+
+	writeHeader(&w, "squirreld_websocket_errors_total", "Connections that failed reading or writing, peers closing or leaving without closing aren't counted", "counter")
+	fmt.Fprintf(&w, "squirreld_websocket_errors_total{op=\"read\"} %d\n", snapshot.ReadErrors)
+	fmt.Fprintf(&w, "squirreld_websocket_errors_total{op=\"write\"} %d\n", snapshot.WriteErrors)
+
+	publishDuration.write(&w, "squirreld_publish_duration_seconds", "Time taken to store and fan out lines sent together by a broadcaster")
+	writeDuration.write(&w, "squirreld_write_duration_seconds", "Time taken to write a websocket frame to a peer")
+	frameSize.write(&w, "squirreld_frame_size_bytes", "Size of websocket frames written to peers, before compression")
+
+	context.Data(200, METRICS_CONTENT_TYPE, w.Bytes())
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writeMetric(w io.Writer, name string, help string, kind string, value float64) {
+	writeHeader(w, name, help, kind)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/omarahm3/squirrel/internal/pkg/common"
 	"go.uber.org/zap/zapcore"
@@ -17,26 +19,103 @@ type ServerOptions struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	MaxMessageSize  int64
+	ScrollbackLines int
+	ScrollbackBytes int
+	// Sessions are only kept in memory when StorageDir is empty
+	StorageDir         string
+	StorageSegmentSize int64
+	StorageRetention   time.Duration
+	// How long a session waits for its broadcaster to reconnect before subscribers are disconnected
+	ReconnectGrace time.Duration
+	// SendQueueSize is how many messages are queued for a client before SlowSubscriberPolicy kicks in
+	SendQueueSize        int
+	SlowSubscriberPolicy string
+	// Compression enables permessage-deflate for peers that ask for it
+	Compression      bool
+	CompressionLevel int
+	// Metrics exposes stats of the server on /metrics in the Prometheus format
+	Metrics bool
+	// AdminToken enables the admin API, requests must send it as a bearer token
+	AdminToken string
+	// ShutdownTimeout is how long queues are drained for on shutdown before connections are cut
+	ShutdownTimeout time.Duration
+	// ShutdownReconnectDelay is how long peers are asked to wait before reconnecting once the server shuts down
+	ShutdownReconnectDelay time.Duration
+	// TLS is served when TLSCert and TLSKey are set, broadcasters must present a certificate
+	// signed by TLSClientCA when it is set
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// BasePath is the path every route is served under, it is empty when routes are at the root
+	BasePath string
 }
 
 const (
-	DEFAULT_ENVIRONMENT       = "prod"
-	DEFAULT_DOMAIN            = "localhost:3000"
-	DEFAULT_PORT              = "3000"
-	DEFAULT_LOG_LEVEL         = "warn"
-	DEFAULT_READ_BUFFER_SIZE  = "0"
-	DEFAULT_WRITE_BUFFER_SIZE = "0"
-	DEFAULT_MAX_MESSAGE_SIZE  = "1024"
+	DEFAULT_ENVIRONMENT          = "prod"
+	DEFAULT_DOMAIN               = "localhost:3000"
+	DEFAULT_PORT                 = "3000"
+	DEFAULT_LOG_LEVEL            = "warn"
+	DEFAULT_READ_BUFFER_SIZE     = "0"
+	DEFAULT_WRITE_BUFFER_SIZE    = "0"
+	DEFAULT_MAX_MESSAGE_SIZE     = "65536"
+	DEFAULT_SCROLLBACK_LINES     = "1000"
+	DEFAULT_SCROLLBACK_BYTES     = "1048576"
+	DEFAULT_STORAGE_DIR          = ""
+	DEFAULT_STORAGE_SEGMENT_SIZE = "10485760"
+	DEFAULT_STORAGE_RETENTION    = "168h"
+	DEFAULT_RECONNECT_GRACE      = "30s"
+	DEFAULT_SEND_QUEUE_SIZE      = "256"
+	DEFAULT_SLOW_SUBSCRIBER      = POLICY_DROP_NEWEST
+	DEFAULT_COMPRESSION          = "true"
+	DEFAULT_METRICS              = "true"
+	DEFAULT_SHUTDOWN_TIMEOUT     = "15s"
+	DEFAULT_SHUTDOWN_RECONNECT   = "2s"
+	// Fastest level, log lines compress well enough without spending more CPU on every message
+	DEFAULT_COMPRESSION_LEVEL = "1"
 )
 
+// What happens to a subscriber whose send queue is full
+const (
+	// Oldest queued message is dropped to make room for the new one
+	POLICY_DROP_OLDEST = "drop_oldest"
+	// New messages are dropped until there is room again, the subscriber is then told how many were skipped
+	POLICY_DROP_NEWEST = "drop_newest"
+	// Subscriber is disconnected, it can reconnect and resume from where it was
+	POLICY_DISCONNECT = "disconnect"
+)
+
+// isSlowSubscriberPolicy tells if policy is one of the slow subscriber policies
+func isSlowSubscriberPolicy(policy string) bool {
+	return policy == POLICY_DROP_OLDEST || policy == POLICY_DROP_NEWEST || policy == POLICY_DISCONNECT
+}
+
 var (
-	env             string
-	domain          string
-	port            string
-	loglevel        string
-	readBufferSize  string
-	writeBufferSize string
-	maxMessageSize  string
+	env                string
+	domain             string
+	port               string
+	loglevel           string
+	readBufferSize     string
+	writeBufferSize    string
+	maxMessageSize     string
+	scrollbackLines    string
+	scrollbackBytes    string
+	storageDir         string
+	storageSegmentSize string
+	storageRetention   string
+	reconnectGrace     string
+	sendQueueSize      string
+	slowSubscriber     string
+	compression        string
+	compressionLevel   string
+	metrics            string
+	adminToken         string
+	shutdownTimeout    string
+	shutdownReconnect  string
+	tlsCert            string
+	tlsKey             string
+	tlsClientCA        string
+	publicUrl          string
+	basePath           string
 )
 
 func fprintf(format string, a ...interface{}) {
@@ -59,15 +138,101 @@ func InitOptions() *ServerOptions {
 	flag.StringVar(&readBufferSize, "read-buffer-size", common.WinningDefault(common.GetEnvVariable("READ_BUFFER_SIZE"), readBufferSize, DEFAULT_READ_BUFFER_SIZE), "Websocket read buffer size")
 	flag.StringVar(&writeBufferSize, "write-buffer-size", common.WinningDefault(common.GetEnvVariable("WRITE_BUFFER_SIZE"), writeBufferSize, DEFAULT_WRITE_BUFFER_SIZE), "Websocket write buffer size")
 	flag.StringVar(&maxMessageSize, "max-message-size", common.WinningDefault(common.GetEnvVariable("MAX_MESSAGE_SIZE"), maxMessageSize, DEFAULT_MAX_MESSAGE_SIZE), "Websocket maximum message size")
+	flag.StringVar(&scrollbackLines, "scrollback-lines", common.WinningDefault(common.GetEnvVariable("SCROLLBACK_LINES"), scrollbackLines, DEFAULT_SCROLLBACK_LINES), "Maximum number of lines kept per broadcaster to replay to late subscribers (0 disables scrollback)")
+	flag.StringVar(&scrollbackBytes, "scrollback-bytes", common.WinningDefault(common.GetEnvVariable("SCROLLBACK_BYTES"), scrollbackBytes, DEFAULT_SCROLLBACK_BYTES), "Maximum size in bytes of lines kept per broadcaster (0 means no size limit)")
+	flag.StringVar(&storageDir, "storage-dir", common.WinningDefault(common.GetEnvVariable("STORAGE_DIR"), storageDir, DEFAULT_STORAGE_DIR), "Directory to persist sessions into (sessions are kept in memory only if empty)")
+	flag.StringVar(&storageSegmentSize, "storage-segment-size", common.WinningDefault(common.GetEnvVariable("STORAGE_SEGMENT_SIZE"), storageSegmentSize, DEFAULT_STORAGE_SEGMENT_SIZE), "Maximum size in bytes of a single session segment file")
+	flag.StringVar(&storageRetention, "storage-retention", common.WinningDefault(common.GetEnvVariable("STORAGE_RETENTION"), storageRetention, DEFAULT_STORAGE_RETENTION), "How long stored sessions are kept after their last line (0 keeps them forever)")
+	flag.StringVar(&reconnectGrace, "reconnect-grace", common.WinningDefault(common.GetEnvVariable("RECONNECT_GRACE"), reconnectGrace, DEFAULT_RECONNECT_GRACE), "How long a session is kept for its broadcaster to reconnect")
+	flag.StringVar(&sendQueueSize, "send-queue-size", common.WinningDefault(common.GetEnvVariable("SEND_QUEUE_SIZE"), sendQueueSize, DEFAULT_SEND_QUEUE_SIZE), "Maximum number of messages queued for a single client, on top of the scrollback replayed when it joins")
+	flag.StringVar(&slowSubscriber, "slow-subscriber-policy", common.WinningDefault(common.GetEnvVariable("SLOW_SUBSCRIBER_POLICY"), slowSubscriber, DEFAULT_SLOW_SUBSCRIBER), "What to do when a subscriber can't keep up (drop_oldest|drop_newest|disconnect)")
+	flag.StringVar(&compression, "compression", common.WinningDefault(common.GetEnvVariable("COMPRESSION"), compression, DEFAULT_COMPRESSION), "Compress messages of peers that support permessage-deflate")
+	flag.StringVar(&compressionLevel, "compression-level", common.WinningDefault(common.GetEnvVariable("COMPRESSION_LEVEL"), compressionLevel, DEFAULT_COMPRESSION_LEVEL), "Compression level from -2 (huffman only) to 9 (best compression)")
+	flag.StringVar(&metrics, "metrics", common.WinningDefault(common.GetEnvVariable("METRICS"), metrics, DEFAULT_METRICS), "Expose server metrics on /metrics in the Prometheus format")
+	flag.StringVar(&adminToken, "admin-token", common.GetEnvVariable("SQUIRREL_ADMIN_TOKEN"), "Token of the admin API on /admin (the admin API is disabled if empty)")
+	flag.StringVar(&shutdownTimeout, "shutdown-timeout", common.WinningDefault(common.GetEnvVariable("SHUTDOWN_TIMEOUT"), shutdownTimeout, DEFAULT_SHUTDOWN_TIMEOUT), "How long pending messages are written for on shutdown before connections are closed")
+	flag.StringVar(&shutdownReconnect, "shutdown-reconnect-delay", common.WinningDefault(common.GetEnvVariable("SHUTDOWN_RECONNECT_DELAY"), shutdownReconnect, DEFAULT_SHUTDOWN_RECONNECT), "How long peers wait before reconnecting once the server shuts down")
+	flag.StringVar(&tlsCert, "tls-cert", common.GetEnvVariable("TLS_CERT"), "PEM certificate file to serve TLS with, it is reloaded once it changes (requires --tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", common.GetEnvVariable("TLS_KEY"), "PEM private key file of the TLS certificate")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", common.GetEnvVariable("TLS_CLIENT_CA"), "PEM CA bundle that signs client certificates, broadcasters must present one when it is set (requires --tls-cert)")
+	flag.StringVar(&publicUrl, "public-url", common.GetEnvVariable("PUBLIC_URL"), "Full URL the server is reached at e.g. https://logs.corp/squirrel, it takes over --domain and sets the base path")
+	flag.StringVar(&basePath, "base-path", common.GetEnvVariable("BASE_PATH"), "Path routes are served under, defaults to the path of --public-url (use / if a proxy strips it)")
 	flag.Parse()
 
+	if !isSlowSubscriberPolicy(slowSubscriber) {
+		fprintf("Invalid slow subscriber policy: [%s], it must be one of %s, %s or %s\n", slowSubscriber, POLICY_DROP_OLDEST, POLICY_DROP_NEWEST, POLICY_DISCONNECT)
+		os.Exit(2)
+	}
+
+	level := common.StrToInt(compressionLevel)
+
+	if !common.IsValidCompressionLevel(level) {
+		fprintf("Invalid compression level: [%d], it must be between -2 and 9\n", level)
+		os.Exit(2)
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		fprintf("Both --tls-cert and --tls-key must be set to serve TLS\n")
+		os.Exit(2)
+	}
+
+	if tlsClientCA != "" && tlsCert == "" {
+		fprintf("--tls-client-ca requires --tls-cert and --tls-key\n")
+		os.Exit(2)
+	}
+
+	secure := env == "prod" || tlsCert != ""
+	serverDomain := common.BuildDomain(domain, "", secure)
+
+	if publicUrl != "" {
+		var err error
+		serverDomain, err = common.ParseServerURL(publicUrl)
+
+		if err != nil {
+			fprintf("Invalid --public-url: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if basePath == "" {
+		basePath = serverDomain.Path
+	}
+
+	if !strings.HasPrefix(basePath, "/") && basePath != "" {
+		fprintf("Invalid --base-path: [%s], it must start with /\n", basePath)
+		os.Exit(2)
+	}
+
+	// Links are under the base path as well, unless the public URL tells where the server is reached
+	if publicUrl == "" {
+		serverDomain = common.BuildDomain(domain, basePath, secure)
+	}
+
 	return &ServerOptions{
-		Env:             env,
-		Domain:          common.BuildDomain(domain, env),
-		Port:            common.StrToInt(port),
-		LogLevel:        common.GetLogLevelFromString(loglevel),
-		ReadBufferSize:  common.StrToInt(readBufferSize),
-		WriteBufferSize: common.StrToInt(writeBufferSize),
-		MaxMessageSize:  common.StrToInt64(maxMessageSize),
+		Env:                    env,
+		Domain:                 serverDomain,
+		Port:                   common.StrToInt(port),
+		LogLevel:               common.GetLogLevelFromString(loglevel),
+		ReadBufferSize:         common.StrToInt(readBufferSize),
+		WriteBufferSize:        common.StrToInt(writeBufferSize),
+		MaxMessageSize:         common.StrToInt64(maxMessageSize),
+		ScrollbackLines:        common.StrToInt(scrollbackLines),
+		ScrollbackBytes:        common.StrToInt(scrollbackBytes),
+		StorageDir:             storageDir,
+		StorageSegmentSize:     common.StrToInt64(storageSegmentSize),
+		StorageRetention:       common.StrToDuration(storageRetention),
+		ReconnectGrace:         common.StrToDuration(reconnectGrace),
+		SendQueueSize:          common.StrToInt(sendQueueSize),
+		SlowSubscriberPolicy:   slowSubscriber,
+		Compression:            common.StrToBool(compression),
+		CompressionLevel:       level,
+		Metrics:                common.StrToBool(metrics),
+		AdminToken:             adminToken,
+		ShutdownTimeout:        common.StrToDuration(shutdownTimeout),
+		ShutdownReconnectDelay: common.StrToDuration(shutdownReconnect),
+		TLSCert:                tlsCert,
+		TLSKey:                 tlsKey,
+		TLSClientCA:            tlsClientCA,
+		BasePath:               strings.TrimSuffix(basePath, "/"),
 	}
 }
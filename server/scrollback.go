@@ -0,0 +1,68 @@
+package server
+
+// Scrollback is a bounded ring buffer of the latest records sent by a broadcaster
+// it is used to replay history to subscribers that join after lines were sent
+type Scrollback struct {
+	records  []Record
+	start    int
+	count    int
+	bytes    int
+	maxBytes int
+}
+
+// maxLines of 0 disables the scrollback, maxBytes of 0 means there is no size limit
+func NewScrollback(maxLines int, maxBytes int) *Scrollback {
+	if maxLines < 0 {
+		maxLines = 0
+	}
+
+	return &Scrollback{
+		records:  make([]Record, maxLines),
+		maxBytes: maxBytes,
+	}
+}
+
+func (s *Scrollback) Append(record Record) {
+	if len(s.records) == 0 {
+		return
+	}
+
+	if s.maxBytes > 0 && record.Size() > s.maxBytes {
+		// A single record can't fit, there is no point of evicting everything for it
+		return
+	}
+
+	if s.count == len(s.records) {
+		s.evict()
+	}
+
+	s.records[(s.start+s.count)%len(s.records)] = record
+	s.count++
+	s.bytes += record.Size()
+
+	for s.maxBytes > 0 && s.bytes > s.maxBytes {
+		s.evict()
+	}
+}
+
+func (s *Scrollback) evict() {
+	s.bytes -= s.records[s.start].Size()
+	s.records[s.start] = Record{}
+	s.start = (s.start + 1) % len(s.records)
+	s.count--
+}
+
+// Records returns a copy of buffered records ordered from the oldest to the newest
+func (s *Scrollback) Records() []Record {
+	records := make([]Record, 0, s.count)
+
+	for i := 0; i < s.count; i++ {
+		records = append(records, s.records[(s.start+i)%len(s.records)])
+	}
+
+	return records
+}
+
+func (s *Scrollback) Len() int {
+	return s.count
+}
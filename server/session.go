@@ -0,0 +1,288 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+// Record is a single line or terminal frame of a session as it is kept by the server
+type Record struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream,omitempty"`
+	Line   string    `json:"line"`
+	// Structured are the fields the broadcaster parsed out of a JSON line
+	Structured *common.StructuredLog `json:"structured,omitempty"`
+	// Truncated lines were cut by the broadcaster to fit in a message
+	Truncated bool `json:"truncated,omitempty"`
+	// Data, Offset, Cols and Rows are only set for terminal frames
+	Data   []byte `json:"data,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Cols   uint16 `json:"cols,omitempty"`
+	Rows   uint16 `json:"rows,omitempty"`
+}
+
+func (r Record) IsFrame() bool {
+	return r.Data != nil
+}
+
+// Size is how much of the scrollback the record takes
+func (r Record) Size() int {
+	return len(r.Line) + len(r.Data) + r.Structured.Size()
+}
+
+// Marshal builds the log line or terminal frame event that is sent to subscribers
+func (r Record) Marshal(clientId string) ([]byte, error) {
+	if r.IsFrame() {
+		message := common.Message{
+			Id:    clientId,
+			Event: common.EVENT_TERM_FRAME,
+			Payload: common.TermFrameMessage{
+				Data:   r.Data,
+				Seq:    r.Seq,
+				Offset: r.Offset,
+				Cols:   r.Cols,
+				Rows:   r.Rows,
+				Time:   &r.Time,
+			},
+		}
+
+		return message.Marshal()
+	}
+
+	message := common.Message{
+		Id:    clientId,
+		Event: common.EVENT_LOG_LINE,
+		Payload: common.LogMessage{
+			Line:       r.Line,
+			Seq:        r.Seq,
+			Stream:     r.Stream,
+			Time:       &r.Time,
+			Structured: r.Structured,
+			Truncated:  r.Truncated,
+		},
+	}
+
+	return message.Marshal()
+}
+
+// Session is the stream of lines of a single broadcaster
+type Session struct {
+	id         string
+	seq        uint64
+	createdAt  time.Time
+	scrollback *Scrollback
+	log        *SessionLog
+	// token and secret are only known when the session was created by this process
+	// otherwise only their hashes are restored from the storage
+	token      string
+	tokenHash  string
+	secret     string
+	secretHash string
+	// expiry tears the session down once its broadcaster didn't come back in time
+	expiry *time.Timer
+	// exit is how the command of the broadcaster ended, if it was started with `squirrel run`
+	exit *common.ProcessExitMessage
+	// bytes of lines and frames appended since the session was created by this process
+	bytes uint64
+}
+
+func NewSession(id string, storage *Storage) *Session {
+	session := &Session{
+		id:         id,
+		createdAt:  time.Now(),
+		scrollback: NewScrollback(options.ScrollbackLines, options.ScrollbackBytes),
+	}
+
+	if storage == nil {
+		session.issueCredentials()
+		return session
+	}
+
+	meta, err := storage.LoadMeta(id)
+
+	if err == nil {
+		session.tokenHash = meta.TokenHash
+		session.secretHash = meta.SecretHash
+		session.createdAt = meta.CreatedAt
+
+		// Session is broadcasting again so how its previous command ended doesn't apply anymore
+		if meta.Exit != nil {
+			err = storage.SaveMeta(id, session.Meta())
+		}
+	} else {
+		session.issueCredentials()
+
+		if errors.Is(err, os.ErrNotExist) {
+			err = storage.SaveMeta(id, session.Meta())
+		}
+
+		if err != nil {
+			zap.L().Error("Error storing session meta, credentials won't survive a restart", zap.String("id", id), zap.Error(err))
+		}
+	}
+
+	log, err := storage.Open(id)
+
+	if err != nil {
+		zap.L().Error("Error opening session storage, lines won't be persisted", zap.String("id", id), zap.Error(err))
+		return session
+	}
+
+	session.log = log
+	session.seq = log.LastSeq()
+
+	return session
+}
+
+// LoadSession restores the scrollback of a session that only exists on the storage
+func LoadSession(id string, storage *Storage) (*Session, error) {
+	session := &Session{
+		id:         id,
+		scrollback: NewScrollback(options.ScrollbackLines, options.ScrollbackBytes),
+	}
+
+	err := storage.ReadRecords(id, func(record Record) error {
+		if session.createdAt.IsZero() {
+			session.createdAt = record.Time
+		}
+
+		session.seq = record.Seq
+		session.scrollback.Append(record)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if meta, err := storage.LoadMeta(id); err == nil {
+		session.exit = meta.Exit
+	}
+
+	return session, nil
+}
+
+// issueCredentials creates the read token shared with subscribers and the secret
+// that only the broadcaster owning this session ID knows
+func (s *Session) issueCredentials() {
+	s.token = common.GenerateToken()
+	s.tokenHash = common.HashToken(s.token)
+	s.secret = common.GenerateToken()
+	s.secretHash = common.HashToken(s.secret)
+}
+
+// Meta is what has to be stored about the session to restore it
+func (s *Session) Meta() SessionMeta {
+	return SessionMeta{
+		TokenHash:  s.tokenHash,
+		SecretHash: s.secretHash,
+		CreatedAt:  s.createdAt,
+		Exit:       s.exit,
+	}
+}
+
+// SetExit records how the command of the broadcaster ended, it returns false
+// if it was already recorded which happens when it is resent after reconnecting
+func (s *Session) SetExit(exit common.ProcessExitMessage) bool {
+	if s.exit != nil && s.exit.StartedAt.Equal(exit.StartedAt) {
+		return false
+	}
+
+	s.exit = &exit
+
+	return true
+}
+
+// ExitMessage builds the process exit event that is sent to subscribers
+func (s *Session) ExitMessage() ([]byte, error) {
+	message := common.Message{
+		Id:      s.id,
+		Event:   common.EVENT_PROCESS_EXIT,
+		Payload: s.exit,
+	}
+
+	return message.Marshal()
+}
+
+func (s *Session) Authorize(token string) bool {
+	return common.TokenMatches(token, s.tokenHash)
+}
+
+func (s *Session) IsOwner(secret string) bool {
+	return common.TokenMatches(secret, s.secretHash)
+}
+
+// Append stores the line unless seq was already received, which happens when
+// a broadcaster resends its pending lines after reconnecting
+func (s *Session) Append(record Record) (Record, bool) {
+	seq := record.Seq
+
+	if seq == 0 {
+		seq = s.seq + 1
+	}
+
+	if seq <= s.seq {
+		zap.S().Debugw("Ignoring duplicate line", "id", s.id, "seq", seq, "lastSeq", s.seq)
+		return Record{}, false
+	}
+
+	if s.seq > 0 && seq > s.seq+1 {
+		zap.S().Warnw("Broadcaster skipped lines", "id", s.id, "from", s.seq+1, "to", seq-1)
+	}
+
+	s.seq = seq
+	s.bytes += uint64(record.Size())
+
+	record.Seq = seq
+	record.Time = time.Now().UTC()
+
+	s.scrollback.Append(record)
+
+	if s.log != nil {
+		if err := s.log.Append(record); err != nil {
+			zap.L().Error("Error persisting session record", zap.String("id", s.id), zap.Error(err))
+		}
+	}
+
+	return record, true
+}
+
+// Since returns scrollback records newer than seq, terminal frames are left out
+// unless frames is set since not every subscriber can render them
+func (s *Session) Since(seq uint64, frames bool) []Record {
+	var records []Record
+
+	for _, record := range s.scrollback.Records() {
+		if record.IsFrame() && !frames {
+			continue
+		}
+
+		if record.Seq > seq {
+			records = append(records, record)
+		}
+	}
+
+	return records
+}
+
+func (s *Session) Close() {
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	if s.log == nil {
+		return
+	}
+
+	if err := s.log.Close(); err != nil {
+		zap.L().Error("Error closing session storage", zap.String("id", s.id), zap.Error(err))
+	}
+
+	s.log = nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+// connections are every websocket connection of the server, identified or not, so they can be drained on shutdown
+var connections = &registry{
+	clients: make(map[*Client]struct{}),
+}
+
+type registry struct {
+	mu       sync.Mutex
+	clients  map[*Client]struct{}
+	draining bool
+	// pumps counts WritePumps that are still running
+	pumps sync.WaitGroup
+}
+
+// add registers the client, it returns false once the server started shutting down
+func (r *registry) add(client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.draining {
+		return false
+	}
+
+	r.clients[client] = struct{}{}
+	r.pumps.Add(1)
+
+	return true
+}
+
+// remove is called by WritePump once the connection is closed
+func (r *registry) remove(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[client]; !ok {
+		return
+	}
+
+	delete(r.clients, client)
+	r.pumps.Done()
+}
+
+// drain tells every client the server is shutting down and closes their send queue
+func (r *registry) drain(message []byte) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+
+	for client := range r.clients {
+		client.shutdown(message)
+	}
+
+	return len(r.clients)
+}
+
+// wait blocks until every WritePump is done or the context is done, connections left are closed
+func (r *registry) wait(ctx context.Context) {
+	done := make(chan struct{})
+
+	go func() {
+		r.pumps.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	zap.S().Warnw("Shutdown timeout is over, closing connections", "connections", len(r.clients))
+
+	for client := range r.clients {
+		client.connection.Close()
+	}
+}
+
+// Close closes the storage of every session, sessions stay on the storage so they can be resumed
+// by another server or once this one is restarted
+func (h *Hub) Close() {
+	for _, s := range h.shards {
+		s.mu.Lock()
+
+		for _, p := range s.sessions {
+			if p.session != nil {
+				p.session.Close()
+			}
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// Shutdown stops accepting requests, asks every peer to reconnect after the reconnect delay
+// and waits for their send queues to be written before closing the sessions
+func Shutdown(httpServer *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+	defer cancel()
+
+	// Websocket connections are hijacked, http.Server only waits for other requests like exports
+	httpDone := make(chan struct{})
+
+	go func() {
+		defer close(httpDone)
+
+		if err := httpServer.Shutdown(ctx); err != nil {
+			zap.L().Error("Error while shutting down HTTP server", zap.Error(err))
+		}
+	}()
+
+	message, err := common.Message{
+		Event: common.EVENT_SERVER_SHUTDOWN,
+		Payload: common.ServerShutdownMessage{
+			ReconnectIn: options.ShutdownReconnectDelay.Milliseconds(),
+		},
+	}.Marshal()
+
+	if err != nil {
+		zap.L().Error("Error while marshaling shutdown event", zap.Error(err))
+	}
+
+	zap.S().Warnw("Draining connections", "connections", connections.drain(message), "timeout", options.ShutdownTimeout)
+
+	connections.wait(ctx)
+	<-httpDone
+
+	hub.Close()
+
+	zap.S().Warn("Server was shut down")
+}
+
+// serve runs the HTTP server until it receives SIGINT or SIGTERM, a second signal exits right away
+func serve(httpServer *http.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		var err error
+
+		// Certificates are served by the TLS config so they can be reloaded
+		if httpServer.TLSConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			common.FatalError("Error while running server", err)
+		}
+	}()
+
+	received := <-signals
+
+	zap.S().Warnw("Shutting down server", "signal", received.String())
+
+	done := make(chan struct{})
+
+	go func() {
+		Shutdown(httpServer)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case received = <-signals:
+		zap.S().Warnw("Server was stopped before it was drained", "signal", received.String())
+		os.Exit(1)
+	}
+}
+
+// shutdownCloseMessage asks peers to reconnect since the server is restarting
+func shutdownCloseMessage() []byte {
+	return websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server is shutting down")
+}
+
+// giveUp is only for connections that were upgraded after draining started
+func giveUp(connection *websocket.Conn) {
+	deadline := time.Now().Add(WRITE_WAIT)
+	_ = connection.WriteControl(websocket.CloseMessage, shutdownCloseMessage(), deadline)
+	connection.Close()
+}
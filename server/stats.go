@@ -0,0 +1,89 @@
+package server
+
+import "sync/atomic"
+
+// Stats are counters of the whole server, they can be updated from any goroutine
+type Stats struct {
+	// DroppedMessages counts messages that were never sent because a client couldn't keep up
+	DroppedMessages uint64
+	// SlowDisconnects counts subscribers that were disconnected for not keeping up
+	SlowDisconnects uint64
+	// LinesReceived and FramesReceived count records published by broadcasters, replays aren't counted
+	LinesReceived  uint64
+	FramesReceived uint64
+	// BytesReceived and BytesSent count websocket message payloads before compression
+	BytesReceived    uint64
+	BytesSent        uint64
+	MessagesReceived uint64
+	MessagesSent     uint64
+	// Connections counts every websocket connection that was accepted, OpenConnections the ones still open
+	Connections     uint64
+	OpenConnections int64
+	// ReadErrors and WriteErrors count connections that failed, peers closing normally aren't errors
+	ReadErrors  uint64
+	WriteErrors uint64
+}
+
+var stats Stats
+
+func (s *Stats) addDropped() {
+	atomic.AddUint64(&s.DroppedMessages, 1)
+}
+
+func (s *Stats) addSlowDisconnect() {
+	atomic.AddUint64(&s.SlowDisconnects, 1)
+}
+
+func (s *Stats) addRecord(record Record) {
+	if record.IsFrame() {
+		atomic.AddUint64(&s.FramesReceived, 1)
+		return
+	}
+
+	atomic.AddUint64(&s.LinesReceived, 1)
+}
+
+func (s *Stats) addReceived(size int) {
+	atomic.AddUint64(&s.MessagesReceived, 1)
+	atomic.AddUint64(&s.BytesReceived, uint64(size))
+}
+
+func (s *Stats) addSent(messages int, size int) {
+	atomic.AddUint64(&s.MessagesSent, uint64(messages))
+	atomic.AddUint64(&s.BytesSent, uint64(size))
+}
+
+func (s *Stats) addConnection() {
+	atomic.AddUint64(&s.Connections, 1)
+	atomic.AddInt64(&s.OpenConnections, 1)
+}
+
+func (s *Stats) removeConnection() {
+	atomic.AddInt64(&s.OpenConnections, -1)
+}
+
+func (s *Stats) addReadError() {
+	atomic.AddUint64(&s.ReadErrors, 1)
+}
+
+func (s *Stats) addWriteError() {
+	atomic.AddUint64(&s.WriteErrors, 1)
+}
+
+// Snapshot returns the current value of every counter
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		DroppedMessages:  atomic.LoadUint64(&s.DroppedMessages),
+		SlowDisconnects:  atomic.LoadUint64(&s.SlowDisconnects),
+		LinesReceived:    atomic.LoadUint64(&s.LinesReceived),
+		FramesReceived:   atomic.LoadUint64(&s.FramesReceived),
+		BytesReceived:    atomic.LoadUint64(&s.BytesReceived),
+		BytesSent:        atomic.LoadUint64(&s.BytesSent),
+		MessagesReceived: atomic.LoadUint64(&s.MessagesReceived),
+		MessagesSent:     atomic.LoadUint64(&s.MessagesSent),
+		Connections:      atomic.LoadUint64(&s.Connections),
+		OpenConnections:  atomic.LoadInt64(&s.OpenConnections),
+		ReadErrors:       atomic.LoadUint64(&s.ReadErrors),
+		WriteErrors:      atomic.LoadUint64(&s.WriteErrors),
+	}
+}
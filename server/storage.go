@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+const (
+	SEGMENT_EXTENSION        = ".log"
+	META_FILE_NAME           = "session.json"
+	RETENTION_SWEEP_INTERVAL = 10 * time.Minute
+)
+
+// Only IDs matching this are allowed to become directory names, that way
+// a peer can't use its ID to write outside of the storage directory
+var sessionIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// Storage persists broadcasters lines into append-only segment files
+// each session gets its own directory with segments named after their first sequence number
+type Storage struct {
+	dir         string
+	segmentSize int64
+	retention   time.Duration
+	mutex       sync.Mutex
+	active      map[string]bool
+}
+
+// SessionMeta is what is kept about a session next to its segments
+type SessionMeta struct {
+	TokenHash  string    `json:"tokenHash"`
+	SecretHash string    `json:"secretHash"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Exit is set once the command wrapped by `squirrel run` is done
+	Exit *common.ProcessExitMessage `json:"exit,omitempty"`
+}
+
+// SessionLog is the writable end of a single session on the storage
+type SessionLog struct {
+	id          string
+	dir         string
+	segmentSize int64
+	file        *os.File
+	size        int64
+	lastSeq     uint64
+	storage     *Storage
+}
+
+func NewStorage(dir string, segmentSize int64, retention time.Duration) (*Storage, error) {
+	err := os.MkdirAll(dir, 0o700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Storage{
+		dir:         dir,
+		segmentSize: segmentSize,
+		retention:   retention,
+		active:      make(map[string]bool),
+	}, nil
+}
+
+func (s *Storage) sessionDir(id string) (string, error) {
+	if !sessionIdPattern.MatchString(id) {
+		return "", fmt.Errorf("Session ID: [%s] is not valid to be stored", id)
+	}
+
+	return filepath.Join(s.dir, id), nil
+}
+
+func (s *Storage) segments(id string) ([]string, error) {
+	dir, err := s.sessionDir(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), SEGMENT_EXTENSION) {
+			continue
+		}
+
+		segments = append(segments, filepath.Join(dir, entry.Name()))
+	}
+
+	// Segment names are zero padded so lexical order is the sequence order
+	sort.Strings(segments)
+
+	return segments, nil
+}
+
+func (s *Storage) Exists(id string) bool {
+	dir, err := s.sessionDir(id)
+
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(dir)
+
+	return err == nil
+}
+
+func (s *Storage) SaveMeta(id string, meta SessionMeta) error {
+	dir, err := s.sessionDir(id)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0o700)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a half written meta behind
+	path := filepath.Join(dir, META_FILE_NAME)
+	err = os.WriteFile(path+".tmp", data, 0o600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *Storage) LoadMeta(id string) (SessionMeta, error) {
+	dir, err := s.sessionDir(id)
+
+	if err != nil {
+		return SessionMeta{}, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, META_FILE_NAME))
+
+	if err != nil {
+		return SessionMeta{}, err
+	}
+
+	var meta SessionMeta
+
+	err = json.Unmarshal(data, &meta)
+
+	if err != nil {
+		return SessionMeta{}, err
+	}
+
+	return meta, nil
+}
+
+// Open returns a log that appends to the session, creating it if needed
+// re-opening an existing session continues after its last stored sequence
+func (s *Storage) Open(id string) (*SessionLog, error) {
+	dir, err := s.sessionDir(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, 0o700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log := &SessionLog{
+		id:          id,
+		dir:         dir,
+		segmentSize: s.segmentSize,
+		storage:     s,
+	}
+
+	segments, err := s.segments(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+
+		err = repairSegment(last)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = readSegment(last, func(record Record) error {
+			log.lastSeq = record.Seq
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Last segment can be empty after a crash right after rotating or once its only partial
+		// record was truncated, records before it all come before its first sequence
+		if firstSeq := segmentFirstSeq(last); log.lastSeq == 0 && firstSeq > 0 {
+			log.lastSeq = firstSeq - 1
+		}
+
+		err = log.openSegment(last)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	s.active[id] = true
+	s.mutex.Unlock()
+
+	return log, nil
+}
+
+// ReadRecords calls fn with every stored record of the session ordered by sequence
+func (s *Storage) ReadRecords(id string, fn func(Record) error) error {
+	segments, err := s.segments(id)
+
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		err = readSegment(segment, fn)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// segmentName is zero padded so lexical order is the sequence order
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, SEGMENT_EXTENSION)
+}
+
+// segmentFirstSeq is the sequence of the first record of the segment, as written in its name
+func segmentFirstSeq(path string) uint64 {
+	seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), SEGMENT_EXTENSION), 10, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return seq
+}
+
+// repairSegment truncates a partial record left at the end of the segment by a crash,
+// otherwise the next record would be appended right after it and be corrupted as well
+func repairSegment(path string) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+
+	if end == len(data) {
+		return nil
+	}
+
+	zap.S().Warnw("Truncating partial record at the end of segment", "segment", path, "bytes", len(data)-end)
+
+	return os.Truncate(path, int64(end))
+}
+
+func readSegment(path string, fn func(Record) error) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	for {
+		data, err := reader.ReadBytes('\n')
+
+		if err != nil {
+			// A trailing line without newline is a record that is still being written
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		var record Record
+
+		if err := json.Unmarshal(data, &record); err != nil {
+			zap.L().Warn("Skipping corrupted record", zap.String("segment", path), zap.Error(err))
+			continue
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Sweep removes sessions that weren't written to for longer than the retention period
+func (s *Storage) Sweep() {
+	entries, err := os.ReadDir(s.dir)
+
+	if err != nil {
+		zap.L().Error("Error reading storage directory", zap.Error(err))
+		return
+	}
+
+	deadline := time.Now().Add(-s.retention)
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		id := entry.Name()
+
+		s.mutex.Lock()
+		active := s.active[id]
+		s.mutex.Unlock()
+
+		if active {
+			continue
+		}
+
+		if s.lastModified(id).After(deadline) {
+			continue
+		}
+
+		zap.S().Infow("Removing expired session from storage", "id", id)
+
+		if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+			zap.L().Error("Error removing expired session", zap.String("id", id), zap.Error(err))
+		}
+	}
+}
+
+func (s *Storage) lastModified(id string) time.Time {
+	var last time.Time
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, id))
+
+	if err != nil {
+		return last
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+
+		if err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	return last
+}
+
+func (s *Storage) RunRetention() {
+	if s.retention <= 0 {
+		zap.S().Info("Storage retention is disabled, sessions will be kept forever")
+		return
+	}
+
+	ticker := time.NewTicker(RETENTION_SWEEP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		s.Sweep()
+		<-ticker.C
+	}
+}
+
+func (l *SessionLog) openSegment(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *SessionLog) rotate(firstSeq uint64) error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	return l.openSegment(filepath.Join(l.dir, segmentName(firstSeq)))
+}
+
+func (l *SessionLog) Append(record Record) error {
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	if l.file == nil || (l.segmentSize > 0 && l.size+int64(len(data)) > l.segmentSize && l.size > 0) {
+		if err := l.rotate(record.Seq); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+
+	if err != nil {
+		return err
+	}
+
+	l.lastSeq = record.Seq
+
+	return nil
+}
+
+func (l *SessionLog) LastSeq() uint64 {
+	return l.lastSeq
+}
+
+func (l *SessionLog) Close() error {
+	l.storage.mutex.Lock()
+	delete(l.storage.active, l.id)
+	l.storage.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.Close()
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageOpenEmptyTailSegment(t *testing.T) {
+	tails := map[string]string{
+		// Crash right after rotating, before the first record of the segment was written
+		"empty": "",
+		// Only record of the segment was cut by a crash, it is truncated when the session is opened
+		"partial": `{"seq":6,"line":"li`,
+	}
+
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			storage, err := NewStorage(t.TempDir(), 1024*1024, 0)
+
+			if err != nil {
+				t.Fatalf("creating storage: %v", err)
+			}
+
+			log, err := storage.Open("session")
+
+			if err != nil {
+				t.Fatalf("opening session: %v", err)
+			}
+
+			for seq := uint64(1); seq <= 5; seq++ {
+				if err := log.Append(Record{Seq: seq, Line: "line"}); err != nil {
+					t.Fatalf("appending record: %v", err)
+				}
+			}
+
+			if err := log.Close(); err != nil {
+				t.Fatalf("closing session: %v", err)
+			}
+
+			if err := os.WriteFile(filepath.Join(log.dir, segmentName(6)), []byte(tail), 0o600); err != nil {
+				t.Fatalf("writing tail segment: %v", err)
+			}
+
+			log, err = storage.Open("session")
+
+			if err != nil {
+				t.Fatalf("opening session again: %v", err)
+			}
+
+			defer log.Close()
+
+			if log.LastSeq() != 5 {
+				t.Fatalf("session continues after line %d instead of 5", log.LastSeq())
+			}
+		})
+	}
+}
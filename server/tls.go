@@ -0,0 +1,153 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omarahm3/squirrel/internal/pkg/common"
+	"go.uber.org/zap"
+)
+
+// How often certificate files are checked for changes
+const TLS_RELOAD_INTERVAL = 10 * time.Second
+
+// certificateReloader serves the certificate of the files and loads them again once they changed,
+// so renewed certificates are picked up without restarting squirreld
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// lastModified is when either of the files was last changed
+func (r *certificateReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+func (r *certificateReloader) load() error {
+	modTime, err := r.lastModified()
+
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.certificate = &certificate
+	r.modTime = modTime
+
+	return nil
+}
+
+// watch reloads the certificate whenever its files change, the current one is kept if they can't be loaded
+// e.g. while the certificate was written but not its key yet, it is tried again on the next check
+func (r *certificateReloader) watch() {
+	ticker := time.NewTicker(TLS_RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTime, err := r.lastModified()
+
+		if err != nil {
+			zap.S().Warnw("Error checking TLS certificate files", "error", err)
+			continue
+		}
+
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		err = r.load()
+
+		if err != nil {
+			zap.L().Error("Error reloading TLS certificate, keeping the current one", zap.Error(err))
+			continue
+		}
+
+		zap.S().Warnw("TLS certificate was reloaded", "cert", r.certFile)
+	}
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.certificate, nil
+}
+
+// NewTLSConfig serves the certificate of the options, client certificates are verified against
+// the client CA when it is set
+func NewTLSConfig() (*tls.Config, error) {
+	reloader, err := newCertificateReloader(options.TLSCert, options.TLSKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	go reloader.watch()
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if options.TLSClientCA == "" {
+		return config, nil
+	}
+
+	pool := x509.NewCertPool()
+
+	if err := common.AppendCertsFromFile(pool, options.TLSClientCA); err != nil {
+		return nil, err
+	}
+
+	// Browsers and listening squirrels don't have certificates, only broadcasters must present one
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return config, nil
+}